@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// 测速后端名称
+const (
+	BackendSpeedtest = "speedtest"
+	BackendIperf3    = "iperf3"
+)
+
+// 测速后端接口，不同的测速实现需返回相同结构的结果
+type Backend interface {
+	// 后端名称，保存到speedtest_results.backend
+	Name() string
+	// 执行一次测速，每个服务器返回一条结果，测速失败的服务器返回Err不为空的结果；
+	// 无法开始测速（如获取服务器列表失败）时返回错误
+	Measure(ctx context.Context, opts MeasureOptions) ([]*MeasureResult, error)
+	// 未指定测试时长和并发连接数时使用的默认值
+	Defaults() (duration time.Duration, connections int)
+}
+
+// 根据名称创建测速后端，名称为空时使用speedtest.net
+func newBackend(name string) (Backend, error) {
+	switch name {
+	case "", BackendSpeedtest:
+		return &speedtestBackend{}, nil
+	case BackendIperf3:
+		if config.Iperf3Server == "" {
+			return nil, fmt.Errorf("使用iperf3后端时必须指定iperf3服务器地址")
+		}
+		path := config.Iperf3Path
+		if path == "" {
+			path = "iperf3"
+		}
+		return &iperf3Backend{servers: splitList(config.Iperf3Server), path: path}, nil
+	default:
+		return nil, fmt.Errorf("未知的测速后端: %s", name)
+	}
+}
+
+// 拆分 host:port 格式的地址，未指定端口时使用默认端口
+func splitHostPort(addr, defaultPort string) (string, string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// 不带端口的IPv6地址可能写在方括号中，如 [2400:3200::1]
+		return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), defaultPort
+	}
+	return host, port
+}
+
+// 拆分以逗号分隔的列表，忽略空白项
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
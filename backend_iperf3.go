@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// 基于自建iperf3服务器的测速后端，通过调用iperf3客户端并解析其JSON输出实现
+type iperf3Backend struct {
+	servers []string // host 或 host:port，多个服务器依次测试
+	path    string   // iperf3可执行文件路径
+}
+
+// iperf3 -J 输出中用到的字段
+type iperf3Output struct {
+	Start struct {
+		Version   string `json:"version"` // 如 iperf 3.9
+		Connected []struct {
+			RemoteHost string `json:"remote_host"` // 实际连接的服务器IP
+		} `json:"connected"`
+	} `json:"start"`
+	Intervals []struct {
+		Streams []struct {
+			RTT int `json:"rtt"` // 微秒，仅发送端且操作系统支持时存在
+		} `json:"streams"`
+		Sum struct {
+			End           float64 `json:"end"` // 距测试开始的秒数
+			BitsPerSecond float64 `json:"bits_per_second"`
+		} `json:"sum"`
+	} `json:"intervals"`
+	End struct {
+		Streams []struct {
+			Sender struct {
+				MinRTT  int `json:"min_rtt"`  // 微秒
+				MaxRTT  int `json:"max_rtt"`  // 微秒
+				MeanRTT int `json:"mean_rtt"` // 微秒
+			} `json:"sender"`
+		} `json:"streams"`
+		SumSent struct {
+			Bytes         int64   `json:"bytes"`
+			BitsPerSecond float64 `json:"bits_per_second"`
+		} `json:"sum_sent"`
+		SumReceived struct {
+			Bytes         int64   `json:"bytes"`
+			BitsPerSecond float64 `json:"bits_per_second"`
+		} `json:"sum_received"`
+	} `json:"end"`
+	Error string `json:"error"`
+}
+
+func (b *iperf3Backend) Name() string {
+	return BackendIperf3
+}
+
+// iperf3默认每个方向测试10秒，使用1个连接
+func (b *iperf3Backend) Defaults() (time.Duration, int) {
+	return 10 * time.Second, 1
+}
+
+// 依次测试每个iperf3服务器，单个服务器失败不影响其余服务器
+func (b *iperf3Backend) Measure(ctx context.Context, opts MeasureOptions) ([]*MeasureResult, error) {
+	source, err := parseSource(opts.Source)
+	if err != nil {
+		return nil, newPhaseError(PhaseSetup, err)
+	}
+	// iperf3使用自己的TCP/UDP协议，无法经过HTTP或SOCKS5代理
+	if opts.Proxy != "" {
+		return nil, newPhaseError(PhaseSetup, fmt.Errorf("iperf3后端不支持代理"))
+	}
+
+	var results []*MeasureResult
+	for _, server := range b.servers {
+		result, err := b.measureServer(ctx, server, source, opts)
+		if err != nil {
+			// 失败的服务器同样记录，取消后不再测试其余服务器
+			log.Printf("iperf3服务器 %s 测速失败: %v", server, err)
+			host, port := splitHostPort(server, "5201")
+			result = &MeasureResult{ServerName: server, ServerHost: net.JoinHostPort(host, port), PacketLoss: -1, TestTime: time.Now(), Err: err}
+		}
+		results = append(results, result)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return results, nil
+}
+
+// 对单个服务器依次执行上传（客户端发送）和下载（-R，服务器发送）测试，测速模式不包括的方向不测试
+func (b *iperf3Backend) measureServer(ctx context.Context, server string, source *sourceAddr, opts MeasureOptions) (*MeasureResult, error) {
+	host, port := splitHostPort(server, "5201")
+	args, err := iperf3ClientArgs(opts.Family, source)
+	if err != nil {
+		return nil, newPhaseError(PhaseSetup, err)
+	}
+	seconds := int(opts.Duration / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	args = append(args, "-t", strconv.Itoa(seconds), "-P", strconv.Itoa(opts.Connections))
+
+	// 启用负载延迟时，测试期间通过TCP建连时间采样延迟
+	var sampler *latencySampler
+	var loadedDownload, loadedUpload time.Duration
+	pinger := tcpPinger(net.JoinHostPort(host, port), opts.Family, source)
+
+	result := &MeasureResult{
+		ServerName: server,
+		ServerHost: net.JoinHostPort(host, port),
+		Family:     opts.Family,
+		PacketLoss: -1, // TCP模式下iperf3不统计丢包
+	}
+
+	// 在传输数据之前通过TCP建连时间测量空闲延迟，作为延迟统计和缓冲膨胀评级的基准
+	var samples []time.Duration
+	err = runPhase(ctx, PhasePing, opts.Timeouts, func(ctx context.Context) error {
+		for i := 0; i < 10; i++ {
+			if i > 0 {
+				time.Sleep(200 * time.Millisecond)
+			}
+			latency, err := pinger()
+			if err != nil {
+				return err
+			}
+			samples = append(samples, latency)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("测试延迟失败: %w", err)
+	}
+	result.setLatencySamples(samples)
+
+	// 1. 测试上传速度
+	var connected string
+	if modeIncludes(opts.Mode, PhaseUpload) {
+		if opts.LoadedLatency {
+			sampler = startLatencySampler(pinger)
+		}
+		var upload *iperf3Output
+		err = runPhase(ctx, PhaseUpload, opts.Timeouts, func(ctx context.Context) (err error) {
+			upload, err = b.run(ctx, host, port, args, false)
+			return err
+		})
+		if sampler != nil {
+			loadedUpload = sampler.Stop()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("iperf3上传测试失败: %w", err)
+		}
+		result.UploadMbps = upload.End.SumReceived.BitsPerSecond / 1e6
+		result.Bytes += upload.End.SumSent.Bytes
+		if len(upload.Start.Connected) > 0 {
+			connected = upload.Start.Connected[0].RemoteHost
+		}
+		result.BackendVersion = upload.Start.Version
+		result.Samples = append(result.Samples, iperf3Samples(PhaseUpload, upload)...)
+
+		// 发送端统计的TCP往返时延是在链路满载时测得的，不能作为空闲延迟；
+		// 负载延迟采样全部失败时用作上传期间的负载延迟
+		if opts.LoadedLatency && loadedUpload == 0 {
+			loadedUpload = iperf3SenderRTT(upload)
+		}
+	}
+
+	// 2. 测试下载速度
+	if modeIncludes(opts.Mode, PhaseDownload) {
+		if opts.LoadedLatency {
+			sampler = startLatencySampler(pinger)
+		}
+		var download *iperf3Output
+		err = runPhase(ctx, PhaseDownload, opts.Timeouts, func(ctx context.Context) (err error) {
+			download, err = b.run(ctx, host, port, args, true)
+			return err
+		})
+		if sampler != nil {
+			loadedDownload = sampler.Stop()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("iperf3下载测试失败: %w", err)
+		}
+		result.DownloadMbps = download.End.SumReceived.BitsPerSecond / 1e6
+		result.Bytes += download.End.SumReceived.Bytes
+		if connected == "" && len(download.Start.Connected) > 0 {
+			connected = download.Start.Connected[0].RemoteHost
+		}
+		result.BackendVersion = download.Start.Version
+		// 吞吐量曲线先下载后上传
+		result.Samples = append(iperf3Samples(PhaseDownload, download), result.Samples...)
+	}
+	result.TestTime = time.Now()
+
+	// 未指定地址族时根据实际连接的服务器地址判断，只测试延迟时无法得知
+	if result.Family == FamilyAuto {
+		result.Family = familyOf(net.ParseIP(connected))
+	}
+	if opts.LoadedLatency {
+		result.setLoadedLatency(loadedDownload, loadedUpload)
+	}
+	return result, nil
+}
+
+// 上传测试期间发送端TCP往返时延的中位数：优先使用每个统计区间的采样，否则使用汇总的平均值；
+// 操作系统不支持时为0
+func iperf3SenderRTT(out *iperf3Output) time.Duration {
+	var samples []time.Duration
+	for _, interval := range out.Intervals {
+		for _, stream := range interval.Streams {
+			if stream.RTT > 0 {
+				samples = append(samples, time.Duration(stream.RTT)*time.Microsecond)
+			}
+		}
+	}
+	if len(samples) > 0 {
+		return medianDuration(samples)
+	}
+	if len(out.End.Streams) > 0 {
+		return time.Duration(out.End.Streams[0].Sender.MeanRTT) * time.Microsecond
+	}
+	return 0
+}
+
+// iperf3默认每秒输出一个统计区间，直接作为吞吐量曲线
+func iperf3Samples(phase string, out *iperf3Output) []ThroughputSample {
+	var samples []ThroughputSample
+	for _, interval := range out.Intervals {
+		samples = append(samples, ThroughputSample{Phase: phase, Seconds: interval.Sum.End, Mbps: interval.Sum.BitsPerSecond / 1e6})
+	}
+	return samples
+}
+
+// 通过TCP建立连接的耗时测量一次往返时延，连接使用与测速相同的地址族和出口
+func tcpPinger(addr, family string, source *sourceAddr) func() (time.Duration, error) {
+	dialer := outboundDialer(family, source, 2*time.Second)
+	return func() (time.Duration, error) {
+		start := time.Now()
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			return 0, err
+		}
+		latency := time.Since(start)
+		conn.Close()
+		return latency, nil
+	}
+}
+
+// 根据地址族和出口生成iperf3客户端参数
+func iperf3ClientArgs(family string, source *sourceAddr) ([]string, error) {
+	var args []string
+	switch family {
+	case FamilyIPv4:
+		args = append(args, "-4")
+	case FamilyIPv6:
+		args = append(args, "-6")
+	}
+	if source != nil {
+		ip := source.ip(family)
+		if ip == nil {
+			return nil, fmt.Errorf("%s没有%s地址", source.name, familyName(family))
+		}
+		// host%dev 表示同时绑定到该网卡（iperf3 3.9及以上版本）
+		bind := ip.String()
+		if source.device != "" {
+			bind += "%" + source.device
+		}
+		args = append(args, "-B", bind)
+	}
+	return args, nil
+}
+
+// 执行一次iperf3测试并解析JSON输出，reverse为true时由服务器向客户端发送数据
+func (b *iperf3Backend) run(ctx context.Context, host, port string, extra []string, reverse bool) (*iperf3Output, error) {
+	args := append([]string{"-c", host, "-p", port, "-J"}, extra...)
+	if reverse {
+		args = append(args, "-R")
+	}
+
+	// 超时或取消时结束iperf3进程
+	out, runErr := exec.CommandContext(ctx, b.path, args...).Output()
+	return parseIperf3Output(out, runErr)
+}
+
+// 解析iperf3 -J的输出。iperf3出错时同样会输出JSON并以非零状态退出，因此优先使用输出中的错误信息
+func parseIperf3Output(out []byte, runErr error) (*iperf3Output, error) {
+	var result iperf3Output
+	if err := json.Unmarshal(out, &result); err != nil {
+		if runErr != nil {
+			return nil, runErr
+		}
+		return nil, fmt.Errorf("解析iperf3输出失败: %v", err)
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("%s", result.Error)
+	}
+	if runErr != nil {
+		return nil, runErr
+	}
+	return &result, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// iperf3 -J 输出的节选：上传测试（发送端，有RTT统计）和下载测试（-R，接收端）
+const (
+	iperf3UploadJSON = `{
+	"start": {"version": "iperf 3.9", "connected": [{"socket": 5, "remote_host": "192.0.2.10", "remote_port": 5201}]},
+	"intervals": [
+		{"streams": [{"socket": 5, "bytes": 11875000, "rtt": 10000}], "sum": {"start": 0, "end": 1.000043, "bits_per_second": 95000000}},
+		{"streams": [{"socket": 5, "bytes": 13125000, "rtt": 30000}], "sum": {"start": 1.000043, "end": 2.000051, "bits_per_second": 105000000}}
+	],
+	"end": {
+		"streams": [{"sender": {"bytes": 25000000, "min_rtt": 9000, "max_rtt": 31000, "mean_rtt": 20000}}],
+		"sum_sent": {"bytes": 25000000, "bits_per_second": 100000000},
+		"sum_received": {"bytes": 24900000, "bits_per_second": 99600000}
+	}
+}`
+	iperf3DownloadJSON = `{
+	"start": {"version": "iperf 3.9", "connected": [{"socket": 5, "remote_host": "192.0.2.10", "remote_port": 5201}]},
+	"intervals": [
+		{"streams": [{"socket": 5, "bytes": 62500000}], "sum": {"start": 0, "end": 1.000021, "bits_per_second": 500000000}}
+	],
+	"end": {
+		"streams": [{"receiver": {"bytes": 125000000}}],
+		"sum_sent": {"bytes": 125100000, "bits_per_second": 500400000},
+		"sum_received": {"bytes": 125000000, "bits_per_second": 500000000}
+	}
+}`
+	iperf3ErrorJSON = `{"start": {"connected": []}, "intervals": [], "end": {}, "error": "error - unable to connect to server: Connection refused"}`
+)
+
+func TestParseIperf3Output(t *testing.T) {
+	exitErr := errors.New("exit status 1")
+	tests := []struct {
+		name    string
+		out     string
+		runErr  error
+		wantErr string
+	}{
+		{"成功", iperf3UploadJSON, nil, ""},
+		{"iperf3报告的错误", iperf3ErrorJSON, exitErr, "error - unable to connect to server: Connection refused"},
+		{"没有输出", "", exitErr, "exit status 1"},
+		{"无法解析的输出", "iperf3: parameter error", nil, "解析iperf3输出失败"},
+		{"输出正常但退出状态非零", iperf3UploadJSON, exitErr, "exit status 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := parseIperf3Output([]byte(tt.out), tt.runErr)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.Start.Version != "iperf 3.9" || len(out.Start.Connected) != 1 || out.Start.Connected[0].RemoteHost != "192.0.2.10" {
+				t.Errorf("start = %+v", out.Start)
+			}
+			if len(out.Intervals) != 2 || out.Intervals[1].Streams[0].RTT != 30000 || out.Intervals[1].Sum.End != 2.000051 {
+				t.Errorf("intervals = %+v", out.Intervals)
+			}
+			if sender := out.End.Streams[0].Sender; sender.MinRTT != 9000 || sender.MaxRTT != 31000 || sender.MeanRTT != 20000 {
+				t.Errorf("sender = %+v", sender)
+			}
+			if out.End.SumSent.Bytes != 25000000 || out.End.SumReceived.BitsPerSecond != 99600000 {
+				t.Errorf("end = %+v", out.End)
+			}
+		})
+	}
+}
+
+func TestIperf3Samples(t *testing.T) {
+	out, err := parseIperf3Output([]byte(iperf3UploadJSON), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ThroughputSample{
+		{Phase: PhaseUpload, Seconds: 1.000043, Mbps: 95},
+		{Phase: PhaseUpload, Seconds: 2.000051, Mbps: 105},
+	}
+	if got := iperf3Samples(PhaseUpload, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("iperf3Samples() = %+v, want %+v", got, want)
+	}
+}
+
+// 用输出固定JSON的脚本代替iperf3，检查从上传和下载测试的输出中得到的结果
+func TestIperf3Measure(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("没有sh，跳过")
+	}
+	dir := t.TempDir()
+	writeFile := func(name, content string, perm os.FileMode) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), perm); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	upload := writeFile("upload.json", iperf3UploadJSON, 0o644)
+	download := writeFile("download.json", iperf3DownloadJSON, 0o644)
+	failed := writeFile("error.json", iperf3ErrorJSON, 0o644)
+	script := writeFile("iperf3", `#!/bin/sh
+case "$2" in localhost) cat '`+failed+`'; exit 1;; esac
+for arg in "$@"; do
+	[ "$arg" = "-R" ] && exec cat '`+download+`'
+done
+cat '`+upload+`'
+`, 0o755)
+
+	// 空闲延迟通过TCP建连时间测量，连接本机的监听端口；服务器名为localhost时脚本模拟iperf3失败
+	addr := listenTest(t, func(conn net.Conn) {})
+	_, port, _ := net.SplitHostPort(addr)
+	b := &iperf3Backend{servers: []string{addr, net.JoinHostPort("localhost", port)}, path: script}
+	opts := MeasureOptions{Mode: ModeFull, Duration: 2 * time.Second, Connections: 1}
+	results, err := b.Measure(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("返回%d个结果，want 2", len(results))
+	}
+
+	r := results[0]
+	if r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	checks := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"上传速度", r.UploadMbps, 99.6},
+		{"下载速度", r.DownloadMbps, 500.0},
+		{"数据量", r.Bytes, int64(25000000 + 125000000)},
+		{"地址族", r.Family, FamilyIPv4},
+		{"版本", r.BackendVersion, "iperf 3.9"},
+		{"服务器", r.ServerHost, addr},
+		{"采样数", len(r.Samples), 3},
+		{"第一个采样", r.Samples[0].Phase, PhaseDownload},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+		}
+	}
+	// 延迟是传输前测得的空闲延迟，而不是上传期间10–30ms的TCP往返时延
+	if r.Latency <= 0 || r.LatencyMin > r.LatencyMedian || r.LatencyMedian > r.LatencyMax || r.LatencyMax >= 10*time.Millisecond {
+		t.Errorf("延迟 平均/最小/中位/最大 = %v/%v/%v/%v", r.Latency, r.LatencyMin, r.LatencyMedian, r.LatencyMax)
+	}
+
+	if err := results[1].Err; err == nil || !strings.Contains(err.Error(), "unable to connect to server") {
+		t.Errorf("失败的服务器: %v", err)
+	}
+}
+
+func TestIperf3SenderRTT(t *testing.T) {
+	withIntervals, err := parseIperf3Output([]byte(iperf3UploadJSON), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summaryOnly, err := parseIperf3Output([]byte(`{"end": {"streams": [{"sender": {"mean_rtt": 15000}}]}}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := parseIperf3Output([]byte(iperf3DownloadJSON), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		out  *iperf3Output
+		want time.Duration
+	}{
+		{"统计区间的采样", withIntervals, 20 * time.Millisecond},
+		{"只有汇总值", summaryOnly, 15 * time.Millisecond},
+		{"接收端没有RTT", receiver, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := iperf3SenderRTT(tt.out); got != tt.want {
+				t.Errorf("iperf3SenderRTT() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
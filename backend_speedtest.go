@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest"
+	"github.com/showwin/speedtest-go/speedtest/transport"
+)
+
+// 丢包测试的采样时长
+const packetLossDuration = 5 * time.Second
+
+// 基于speedtest.net（Ookla）服务器的测速后端
+type speedtestBackend struct{}
+
+func (b *speedtestBackend) Name() string {
+	return BackendSpeedtest
+}
+
+// speedtest-go默认下载和上传各测试15秒，并发连接数与CPU核数相同
+func (b *speedtestBackend) Defaults() (time.Duration, int) {
+	return 15 * time.Second, runtime.NumCPU()
+}
+
+// 执行一次完整测速：获取用户信息、选择服务器，再依次对每个服务器测试延迟、下载和上传速度
+func (b *speedtestBackend) Measure(ctx context.Context, opts MeasureOptions) ([]*MeasureResult, error) {
+	// 指定了出口时，获取用户信息和服务器列表、延迟、下载和上传测试的连接都绑定到该出口
+	source, err := parseSource(opts.Source)
+	if err != nil {
+		return nil, newPhaseError(PhaseSetup, err)
+	}
+	// 指定了代理时所有HTTP请求都经过代理，地址族和出口作用于到代理服务器的连接
+	proxy, err := parseProxy(opts.Proxy)
+	if err != nil {
+		return nil, newPhaseError(PhaseSetup, err)
+	}
+
+	// 每次测速使用独立的客户端，避免多次测速之间累计的数据量互相影响
+	recorder := &familyRecorder{}
+	counter := &byteCounter{}
+	client := speedtest.New(speedtest.WithDoer(newSpeedtestHTTPClient(opts.Family, source, proxy, recorder, counter)))
+	client.SetCaptureTime(opts.Duration)
+	client.SetNThread(opts.Connections)
+
+	// 1. 获取用户信息
+	// 超时后请求可能仍在后台进行，结果通过通道传回，只在阶段正常结束时读取
+	fetchedUser := make(chan *speedtest.User, 1)
+	err = runPhase(ctx, PhaseSetup, opts.Timeouts, func(ctx context.Context) error {
+		user, err := client.FetchUserInfoContext(ctx)
+		fetchedUser <- user
+		return err
+	})
+	var user *speedtest.User
+	if err == nil {
+		user = <-fetchedUser
+	} else {
+		// 使用自定义服务器时允许离线测速，此时运营商信息为空；请求仍未结束时继续测速会混入其流量
+		if opts.ServerURL == "" || ctx.Err() != nil || phaseAbandoned(err) {
+			return nil, fmt.Errorf("获取用户信息失败: %w", err)
+		}
+		user = &speedtest.User{}
+	}
+
+	// 2. 选择服务器
+	var targets speedtest.Servers
+	if opts.ServerURL != "" {
+		// 使用自定义服务器，例如另一个以 -serve-test 模式运行的实例
+		server, err := client.CustomServer(opts.ServerURL)
+		if err != nil {
+			return nil, newPhaseError(PhaseSetup, fmt.Errorf("无效的服务器地址: %v", err))
+		}
+		targets = speedtest.Servers{server}
+	} else {
+		// 获取全球Speedtest服务器列表
+		fetchedServers := make(chan speedtest.Servers, 1)
+		err := runPhase(ctx, PhaseSetup, opts.Timeouts, func(ctx context.Context) error {
+			servers, err := client.FetchServerListContext(ctx)
+			fetchedServers <- servers
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("获取服务器列表失败: %w", err)
+		}
+
+		targets, err = selectServers(<-fetchedServers, opts.ServerIDs, opts.ServerCount)
+		if err != nil {
+			return nil, newPhaseError(PhaseSetup, err)
+		}
+	}
+
+	// 3. 依次测试每个服务器，单个服务器失败不影响其余服务器
+	// 每个服务器的流量为上一个服务器结束后传输的数据量，第一个服务器包括获取服务器列表等请求
+	var results []*MeasureResult
+	var counted int64
+	for _, server := range targets {
+		// 清空上一个服务器累计的数据量，保证吞吐量采样从0开始
+		client.Reset()
+		result, err := measureServer(ctx, client, user, server, source, proxy, opts)
+		if err == nil {
+			// 最后建立的连接是上传测试到该服务器的连接
+			result.Family = recorder.get()
+		} else {
+			// 失败的服务器同样记录，取消后不再测试其余服务器
+			log.Printf("服务器 %s (%s) 测速失败: %v", server.Name, server.ID, err)
+			result = &MeasureResult{PacketLoss: -1, TestTime: time.Now(), Err: err}
+			setServerInfo(result, user, server)
+		}
+		total := counter.total()
+		result.Bytes = total - counted
+		counted = total
+		results = append(results, result)
+		// 某个阶段取消后仍在后台传输时，继续测试其余服务器会混入其流量
+		if ctx.Err() != nil || phaseAbandoned(err) {
+			break
+		}
+	}
+	return results, nil
+}
+
+// 对单个服务器测试延迟、丢包、下载和上传速度
+func measureServer(ctx context.Context, client *speedtest.Speedtest, user *speedtest.User, server *speedtest.Server, source *sourceAddr, proxy *url.URL, opts MeasureOptions) (*MeasureResult, error) {
+	// 测试延迟
+	var samples []time.Duration
+	err := runPhase(ctx, PhasePing, opts.Timeouts, func(ctx context.Context) error {
+		return server.PingTestContext(ctx, func(latency time.Duration) {
+			samples = append(samples, latency)
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("测试延迟失败: %w", err)
+	}
+
+	// 测试丢包率，服务器不支持时为-1
+	// 丢包测试使用UDP，无法经过代理；自定义服务器（如 -serve-test）没有Ookla的丢包测试服务
+	packetLoss := -1.0
+	if proxy == nil && opts.ServerURL == "" {
+		packetLoss = measurePacketLoss(ctx, server, opts.Family, source)
+	}
+
+	// 测试下载速度，启用负载延迟时同时采样延迟
+	var sampler *latencySampler
+	var loadedDownload, loadedUpload time.Duration
+	var samplesDownload, samplesUpload []ThroughputSample
+	if modeIncludes(opts.Mode, PhaseDownload) {
+		if opts.LoadedLatency {
+			sampler = startLatencySampler(httpPinger(server, opts.Family, source, proxy))
+		}
+		throughput := startThroughputSampler(PhaseDownload, client.GetTotalDownload)
+		err = runPhase(ctx, PhaseDownload, opts.Timeouts, server.DownloadTestContext)
+		samplesDownload = throughput.Stop()
+		if sampler != nil {
+			loadedDownload = sampler.Stop()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("测试下载速度失败: %w", err)
+		}
+	}
+
+	// 测试上传速度
+	if modeIncludes(opts.Mode, PhaseUpload) {
+		if opts.LoadedLatency {
+			sampler = startLatencySampler(httpPinger(server, opts.Family, source, proxy))
+		}
+		throughput := startThroughputSampler(PhaseUpload, client.GetTotalUpload)
+		err = runPhase(ctx, PhaseUpload, opts.Timeouts, server.UploadTestContext)
+		samplesUpload = throughput.Stop()
+		if sampler != nil {
+			loadedUpload = sampler.Stop()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("测试上传速度失败: %w", err)
+		}
+	}
+
+	result := &MeasureResult{
+		Latency:    server.Latency,
+		PacketLoss: packetLoss,
+		// 转换单位：字节/秒 -> Mbps（1 B/s = 8 bit/s，1 Mbps = 1e6 bit/s）
+		DownloadMbps: float64(server.DLSpeed) * 8 / 1e6,
+		UploadMbps:   float64(server.ULSpeed) * 8 / 1e6,
+		TestTime:     time.Now(),
+		Samples:      append(samplesDownload, samplesUpload...),
+	}
+	setServerInfo(result, user, server)
+	result.setLatencySamples(samples)
+	if opts.LoadedLatency {
+		result.setLoadedLatency(loadedDownload, loadedUpload)
+	}
+	return result, nil
+}
+
+// 填充结果中的运营商、公网IP、服务器信息和后端版本，成功和失败的结果都保存这些信息
+func setServerInfo(result *MeasureResult, user *speedtest.User, server *speedtest.Server) {
+	result.ISP = user.Isp
+	result.PublicIP = user.IP
+	result.ServerName = server.Name
+	result.ServerCountry = server.Country
+	result.ServerDistance = server.Distance
+	result.ServerHost = server.Host
+	result.ServerID = server.ID
+	result.ServerSponsor = server.Sponsor
+	result.ServerLat = server.Lat
+	result.ServerLon = server.Lon
+	result.BackendVersion = "speedtest-go " + speedtest.Version()
+}
+
+// 创建speedtest客户端使用的HTTP客户端：只连接指定地址族的地址并绑定到指定的出口，记录实际使用的地址族和收发的数据量；
+// proxy不为nil时经该代理（HTTP CONNECT或SOCKS5）转发，否则按环境变量决定是否使用代理
+//
+// 不能通过speedtest.WithUserConfig设置拨号参数：speedtest.New会把http.DefaultClient的
+// Transport指向该客户端，修改其配置会影响程序中所有使用http.DefaultClient的请求
+func newSpeedtestHTTPClient(family string, source *sourceAddr, proxy *url.URL, recorder *familyRecorder, counter *byteCounter) *http.Client {
+	transport := &http.Transport{
+		Proxy:                 proxyFunc(proxy),
+		DialContext:           counter.dialContext(recorder.dialContext(outboundDialer(family, source, 30*time.Second))),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{Transport: userAgentTransport{transport}}
+}
+
+// 为请求设置speedtest.net要求的User-Agent
+type userAgentTransport struct {
+	http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", speedtest.DefaultUserAgent)
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// 通过请求服务器的latency.txt测量一次往返时延，使用独立的连接以免与测速流量共用连接池
+func httpPinger(server *speedtest.Server, family string, source *sourceAddr, proxy *url.URL) func() (time.Duration, error) {
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http.Transport{
+			Proxy:       proxyFunc(proxy),
+			DialContext: outboundDialer(family, source, 2*time.Second).DialContext,
+		},
+	}
+	u, err := url.Parse(server.URL)
+	if err == nil {
+		u.Path = path.Dir(u.Path)
+		u = u.JoinPath("latency.txt")
+	}
+	return func() (time.Duration, error) {
+		if err != nil {
+			return 0, err
+		}
+		start := time.Now()
+		resp, err := client.Get(u.String())
+		if err != nil {
+			return 0, err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return time.Since(start), nil
+	}
+}
+
+// 通过Ookla服务器的UDP丢包测试协议测量丢包率(%)，服务器不支持时返回-1
+func measurePacketLoss(ctx context.Context, server *speedtest.Server, family string, source *sourceAddr) float64 {
+	if server.Host == "" {
+		return -1
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, packetLossDuration)
+	defer cancel()
+
+	loss := -1.0
+	analyzer := speedtest.NewPacketLossAnalyzer(&speedtest.PacketLossAnalyzerOptions{
+		SamplingDuration: packetLossDuration,
+		TCPDialer:        outboundDialer(family, source, 5*time.Second),
+		UDPDialer:        outboundDialer(family, source, 5*time.Second),
+	})
+	err := analyzer.RunWithContext(ctx, server.Host, func(pl *transport.PLoss) {
+		loss = pl.LossPercent()
+	})
+	if err != nil {
+		return -1
+	}
+	return loss
+}
+
+// 选择要测试的服务器：指定了ID列表时按列表顺序选择；否则count大于1时选择距离最近且可连通的count个服务器，
+// 默认自动选择最近的一个服务器
+func selectServers(servers speedtest.Servers, serverIDs []string, count int) (speedtest.Servers, error) {
+	if len(serverIDs) > 0 {
+		var targets speedtest.Servers
+		for _, serverID := range serverIDs {
+			server, err := selectServer(servers, serverID)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, server)
+		}
+		return targets, nil
+	}
+
+	if count <= 1 {
+		server, err := selectServer(servers, "")
+		if err != nil {
+			return nil, err
+		}
+		return speedtest.Servers{server}, nil
+	}
+
+	// 服务器列表已按距离排序，跳过获取列表时ping超时的服务器
+	var targets speedtest.Servers
+	for _, s := range servers {
+		if s.Latency == speedtest.PingTimeout {
+			continue
+		}
+		targets = append(targets, s)
+		if len(targets) == count {
+			break
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("筛选服务器失败: 没有可用的服务器")
+	}
+	return targets, nil
+}
+
+// 根据服务器ID选择服务器，ID为空时自动选择最近的服务器
+func selectServer(servers speedtest.Servers, serverID string) (*speedtest.Server, error) {
+	if serverID == "" {
+		targets, err := servers.FindServer([]int{}) // 空参数表示自动筛选
+		if err != nil {
+			return nil, fmt.Errorf("筛选服务器失败: %v", err)
+		}
+		return targets[0], nil // 选择第一个（最近的）服务器
+	}
+
+	id, err := strconv.Atoi(serverID)
+	if err != nil {
+		return nil, fmt.Errorf("无效的服务器ID: %v", err)
+	}
+	for _, s := range servers {
+		if s.ID == strconv.Itoa(id) {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("未找到ID为%d的服务器", id)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 浏览器测速的接口不需要登录，限制单个请求的数据量
+const (
+	browserMaxChunks     = 100     // 下载测试每个请求最多返回的1MB数据块数，与页面请求的数量相同
+	browserMaxUploadSize = 8 << 20 // 上传测试的请求体上限，页面每次上传4MB
+	browserMaxResultSize = 4 << 10 // 提交测速结果的请求体上限
+)
+
+// 浏览器提交的测速结果的合理范围，超出时视为无效结果
+const (
+	browserMaxSpeed   = 100000 // Mbps
+	browserMaxLatency = 60000  // ms
+)
+
+// 浏览器测速（访问者浏览器↔本机）提交的结果
+type BrowserTestResult struct {
+	DownloadSpeed float64 `json:"download_speed"`
+	UploadSpeed   float64 `json:"upload_speed"`
+	Latency       float64 `json:"latency"`
+	Jitter        float64 `json:"jitter"`
+}
+
+// 校验提交的测速结果，拒绝负数、NaN和超出合理范围的值
+func (r BrowserTestResult) validate() error {
+	values := []struct {
+		name  string
+		value float64
+		max   float64
+	}{
+		{"下载速度", r.DownloadSpeed, browserMaxSpeed},
+		{"上传速度", r.UploadSpeed, browserMaxSpeed},
+		{"延迟", r.Latency, browserMaxLatency},
+		{"抖动", r.Jitter, browserMaxLatency},
+	}
+	for _, v := range values {
+		// NaN与任何值比较都为false，用取反的范围判断同时排除NaN
+		if !(v.value >= 0 && v.value <= v.max) {
+			return fmt.Errorf("%s无效: %v", v.name, v.value)
+		}
+	}
+	return nil
+}
+
+// 获取访问者IP（去除端口部分）
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// 下载测试：返回ckSize个1MB的随机数据块，与LibreSpeed的garbage.php一致
+func browserGarbageHandler(w http.ResponseWriter, r *http.Request) {
+	chunks, err := strconv.Atoi(r.URL.Query().Get("ckSize"))
+	if err != nil || chunks <= 0 {
+		chunks = 4
+	}
+	if chunks > browserMaxChunks {
+		chunks = browserMaxChunks
+	}
+
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(chunks)*int64(len(garbageChunk)), 10))
+	writeGarbage(w, int64(chunks)*int64(len(garbageChunk)))
+}
+
+// 上传测试：读取并丢弃请求体，与LibreSpeed的empty.php一致
+func browserEmptyHandler(w http.ResponseWriter, r *http.Request) {
+	_, err := io.Copy(io.Discard, http.MaxBytesReader(w, r.Body, browserMaxUploadSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "请求体过大", http.StatusRequestEntityTooLarge)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+}
+
+// 延迟测试：返回空响应
+func browserPingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 保存浏览器测速结果，访问者IP由服务端确定
+func browserResultHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var result BrowserTestResult
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, browserMaxResultSize)).Decode(&result); err != nil {
+		http.Error(w, "无效的测速结果", http.StatusBadRequest)
+		return
+	}
+	if err := result.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		log.Printf("%v", err)
+		http.Error(w, "保存结果失败", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	insertSQL := `
+	INSERT INTO browser_results (visitor_ip, user_agent, latency, jitter, download_speed, upload_speed, test_time)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err = db.Exec(insertSQL, clientIP(r), r.UserAgent(), result.Latency, result.Jitter, result.DownloadSpeed, result.UploadSpeed, time.Now().Unix())
+	if err != nil {
+		log.Printf("插入数据失败: %v", err)
+		http.Error(w, "保存结果失败", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"visitor_ip": clientIP(r),
+	})
+}
+
+// 获取浏览器测速图表数据，按时间从旧到新排列
+func browserChartDataHandler(limit int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db, err := openDatabase()
+		if err != nil {
+			log.Printf("%v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer db.Close()
+
+		rows, err := db.Query("SELECT test_time, visitor_ip, download_speed, upload_speed, latency FROM browser_results ORDER BY test_time DESC LIMIT ?", limit)
+		if err != nil {
+			log.Printf("查询数据失败: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		var timestamps, visitorIPs []string
+		var downloadData, uploadData, latencyData []float64
+		for rows.Next() {
+			var testTime int64
+			var visitorIP string
+			var downloadSpeed, uploadSpeed, latency float64
+			if err := rows.Scan(&testTime, &visitorIP, &downloadSpeed, &uploadSpeed, &latency); err != nil {
+				log.Printf("扫描数据失败: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			timestamps = append(timestamps, formatAPITime(testTime))
+			visitorIPs = append(visitorIPs, visitorIP)
+			downloadData = append(downloadData, downloadSpeed)
+			uploadData = append(uploadData, uploadSpeed)
+			latencyData = append(latencyData, latency)
+		}
+
+		reverseStringSlice(timestamps)
+		reverseStringSlice(visitorIPs)
+		reverseFloat64Slice(downloadData)
+		reverseFloat64Slice(uploadData)
+		reverseFloat64Slice(latencyData)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"timestamps":   timestamps,
+			"visitorIPs":   visitorIPs,
+			"downloadData": downloadData,
+			"uploadData":   uploadData,
+			"latencyData":  latencyData,
+		})
+	}
+}
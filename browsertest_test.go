@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBrowserTestResultValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		result  BrowserTestResult
+		wantErr bool
+	}{
+		{"正常", BrowserTestResult{DownloadSpeed: 950.5, UploadSpeed: 40, Latency: 12.3, Jitter: 1.2}, false},
+		{"全为0", BrowserTestResult{}, false},
+		{"上限", BrowserTestResult{DownloadSpeed: browserMaxSpeed, Latency: browserMaxLatency}, false},
+		{"负数", BrowserTestResult{DownloadSpeed: -1}, true},
+		{"NaN", BrowserTestResult{UploadSpeed: math.NaN()}, true},
+		{"无穷大", BrowserTestResult{Latency: math.Inf(1)}, true},
+		{"速度过大", BrowserTestResult{UploadSpeed: browserMaxSpeed + 1}, true},
+		{"抖动过大", BrowserTestResult{Jitter: 1e9}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.result.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBrowserResultHandlerRejectsInvalidResults(t *testing.T) {
+	openTestDatabase(t)
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"负数", `{"download_speed": -5, "upload_speed": 10, "latency": 5, "jitter": 1}`},
+		{"超出范围", `{"download_speed": 1e300, "upload_speed": 10, "latency": 5, "jitter": 1}`},
+		{"无法解析", `{"download_speed": "fast"}`},
+		{"请求体过大", `{"download_speed": 1, "padding": "` + strings.Repeat("x", browserMaxResultSize) + `"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			browserResultHandler(w, httptest.NewRequest(http.MethodPost, "/api/browser-test/result", strings.NewReader(tt.body)))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("状态码 = %d, want %d", w.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestBrowserTestSizeLimits(t *testing.T) {
+	w := httptest.NewRecorder()
+	browserGarbageHandler(w, httptest.NewRequest(http.MethodGet, "/api/browser-test/garbage?ckSize=100000", nil))
+	if got, want := w.Header().Get("Content-Length"), strconv.Itoa(browserMaxChunks*len(garbageChunk)); got != want {
+		t.Errorf("下载测试的Content-Length = %s, want %s", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	body := strings.NewReader(strings.Repeat("x", browserMaxUploadSize+1))
+	browserEmptyHandler(w, httptest.NewRequest(http.MethodPost, "/api/browser-test/empty", body))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("上传测试超过上限时状态码 = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// 负载期间延迟采样间隔
+const loadedLatencyInterval = 250 * time.Millisecond
+
+// 在下载或上传测试期间持续采样延迟
+type latencySampler struct {
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	samples []time.Duration
+}
+
+// 启动延迟采样，ping返回一次往返时延，失败的采样会被忽略
+func startLatencySampler(ping func() (time.Duration, error)) *latencySampler {
+	s := &latencySampler{stop: make(chan struct{})}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(loadedLatencyInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				if latency, err := ping(); err == nil {
+					s.mu.Lock()
+					s.samples = append(s.samples, latency)
+					s.mu.Unlock()
+				}
+			}
+		}
+	}()
+	return s
+}
+
+// 停止采样并返回延迟中位数，没有成功的采样时返回0
+func (s *latencySampler) Stop() time.Duration {
+	close(s.stop)
+	s.wg.Wait()
+	return medianDuration(s.samples)
+}
+
+// 计算时长的中位数
+func medianDuration(samples []time.Duration) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// 根据负载延迟相对空闲延迟的增加量评定缓冲膨胀等级（A–F）
+func bufferbloatGrade(idle, download, upload time.Duration) string {
+	increase := download - idle
+	if upload-idle > increase {
+		increase = upload - idle
+	}
+
+	switch {
+	case increase < 30*time.Millisecond:
+		return "A"
+	case increase < 60*time.Millisecond:
+		return "B"
+	case increase < 200*time.Millisecond:
+		return "C"
+	case increase < 400*time.Millisecond:
+		return "D"
+	default:
+		return "F"
+	}
+}
+
+// 根据负载延迟采样结果填充测速结果，未采样到负载延迟时不评级
+func (r *MeasureResult) setLoadedLatency(download, upload time.Duration) {
+	r.LatencyDownload = download
+	r.LatencyUpload = upload
+	if download == 0 && upload == 0 {
+		return
+	}
+	idle := r.LatencyMedian
+	if idle == 0 {
+		idle = r.Latency
+	}
+	r.BufferbloatGrade = bufferbloatGrade(idle, download, upload)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBufferbloatGrade(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name                   string
+		idle, download, upload time.Duration
+		want                   string
+	}{
+		{"没有增加", 20 * ms, 20 * ms, 20 * ms, "A"},
+		{"负载延迟低于空闲延迟", 20 * ms, 15 * ms, 18 * ms, "A"},
+		{"A的上限", 20 * ms, 49 * ms, 0, "A"},
+		{"B的下限", 20 * ms, 50 * ms, 0, "B"},
+		{"C的下限", 20 * ms, 80 * ms, 0, "C"},
+		{"D的下限", 20 * ms, 220 * ms, 0, "D"},
+		{"F的下限", 20 * ms, 420 * ms, 0, "F"},
+		{"取上传和下载中增加较多的", 20 * ms, 30 * ms, 300 * ms, "D"},
+		{"只测试了上传", 20 * ms, 0, 90 * ms, "C"},
+		{"空闲延迟为0", 0, 10 * ms, 29 * ms, "A"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bufferbloatGrade(tt.idle, tt.download, tt.upload); got != tt.want {
+				t.Errorf("bufferbloatGrade(%v, %v, %v) = %s, want %s", tt.idle, tt.download, tt.upload, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetLoadedLatency(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name             string
+		result           MeasureResult
+		download, upload time.Duration
+		want             string
+	}{
+		{"以延迟中位数为空闲延迟", MeasureResult{Latency: 100 * ms, LatencyMedian: 10 * ms}, 100 * ms, 0, "C"},
+		{"没有中位数时使用平均延迟", MeasureResult{Latency: 100 * ms}, 100 * ms, 0, "A"},
+		{"没有负载延迟采样时不评级", MeasureResult{Latency: 10 * ms, LatencyMedian: 10 * ms}, 0, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.result
+			r.setLoadedLatency(tt.download, tt.upload)
+			if r.BufferbloatGrade != tt.want {
+				t.Errorf("等级 = %q, want %q", r.BufferbloatGrade, tt.want)
+			}
+			if r.LatencyDownload != tt.download || r.LatencyUpload != tt.upload {
+				t.Errorf("负载延迟 = %v/%v, want %v/%v", r.LatencyDownload, r.LatencyUpload, tt.download, tt.upload)
+			}
+		})
+	}
+}
+
+func TestMedianDuration(t *testing.T) {
+	tests := []struct {
+		samples []time.Duration
+		want    time.Duration
+	}{
+		{nil, 0},
+		{[]time.Duration{5}, 5},
+		{[]time.Duration{30, 10, 20}, 20},
+		{[]time.Duration{40, 10, 30, 20}, 25},
+	}
+	for _, tt := range tests {
+		samples := append([]time.Duration(nil), tt.samples...)
+		if got := medianDuration(samples); got != tt.want {
+			t.Errorf("medianDuration(%v) = %v, want %v", tt.samples, got, tt.want)
+		}
+		// 不修改传入的采样顺序
+		for i := range samples {
+			if samples[i] != tt.samples[i] {
+				t.Errorf("medianDuration修改了采样: %v", samples)
+				break
+			}
+		}
+	}
+}
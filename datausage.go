@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// 流量预算接近上限时自动测速的处理方式
+const (
+	BudgetActionPing = "ping" // 降级为只测试延迟（默认）
+	BudgetActionSkip = "skip" // 跳过测速
+)
+
+// 流量预算的数据量单位：1 MB = 1024×1024字节
+const bytesPerMB = 1 << 20
+
+// 估算测速用量时最多读取的测速记录数，足以覆盖最近5轮测速
+const estimateRecordLimit = 200
+
+// 统计经过的连接收发的字节数，用于计算每次测速消耗的流量
+type byteCounter struct {
+	n atomic.Int64
+}
+
+// 返回累计收发的字节数
+func (c *byteCounter) total() int64 {
+	return c.n.Load()
+}
+
+// 包装拨号函数，统计建立的每个连接收发的字节数
+func (c *byteCounter) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: conn, counter: c}, nil
+	}
+}
+
+// 统计收发字节数的连接
+type countingConn struct {
+	net.Conn
+	counter *byteCounter
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.counter.n.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.counter.n.Add(int64(n))
+	return n, err
+}
+
+// 格式化字节数，如 1.25 GB、300.0 MB
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
+// 校验流量预算配置
+func (b DataBudgetConfig) validate() error {
+	if b.MonthlyMB < 0 {
+		return fmt.Errorf("每月流量上限不能为负数")
+	}
+	if b.ResetDay < 0 || b.ResetDay > 28 {
+		return fmt.Errorf("无效的结算日: %d，仅支持1到28", b.ResetDay)
+	}
+	if b.Threshold < 0 || b.Threshold > 1 {
+		return fmt.Errorf("无效的流量预算阈值: %g，仅支持0到1", b.Threshold)
+	}
+	switch b.Action {
+	case "", BudgetActionPing, BudgetActionSkip:
+	default:
+		return fmt.Errorf("未知的流量预算处理方式: %s，仅支持ping和skip", b.Action)
+	}
+	return nil
+}
+
+// 接近上限时的处理方式，默认降级为只测试延迟
+func (b DataBudgetConfig) action() string {
+	if b.Action == "" {
+		return BudgetActionPing
+	}
+	return b.Action
+}
+
+// 返回now所在计费周期的起止时间，周期从每月结算日的0点开始
+func (b DataBudgetConfig) period(now time.Time) (time.Time, time.Time) {
+	day := b.ResetDay
+	if day <= 0 {
+		day = 1
+	}
+	start := time.Date(now.Year(), now.Month(), day, 0, 0, 0, 0, now.Location())
+	if now.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start, start.AddDate(0, 1, 0)
+}
+
+// 本计费周期的流量用量
+type dataUsage struct {
+	Interface   string // 统计的出口，为空时统计所有测速
+	PeriodStart time.Time
+	PeriodEnd   time.Time
+	Used        int64   // 已用字节数
+	Budget      int64   // 上限字节数，0表示不限制
+	Threshold   float64 // 已用流量达到上限的该比例后视为接近上限
+	Estimate    int64   // 按最近几轮测速估算的下一轮测速用量，没有记录时为0
+}
+
+// 剩余字节数，没有上限或已超出时为0
+func (u *dataUsage) remaining() int64 {
+	if u.Budget <= u.Used {
+		return 0
+	}
+	return u.Budget - u.Used
+}
+
+// 是否接近上限：已用流量达到阈值，或剩余流量不足以再完成一轮测速
+func (u *dataUsage) near() bool {
+	if u.Budget <= 0 {
+		return false
+	}
+	return float64(u.Used) >= float64(u.Budget)*u.Threshold || u.Used+u.Estimate > u.Budget
+}
+
+// 查询本计费周期的流量用量，uplink为空时统计所有测速；mode用于估算下一轮测速的用量
+// 浏览器测速的流量不经过本机的出口，不计入用量
+func queryDataUsage(budget DataBudgetConfig, uplink, mode string, now time.Time) (*dataUsage, error) {
+	// 结算日按显示时区计算
+	start, end := budget.period(now.In(displayLocation))
+	usage := &dataUsage{
+		Interface:   uplink,
+		PeriodStart: start,
+		PeriodEnd:   end,
+		Budget:      int64(budget.MonthlyMB) * bytesPerMB,
+		Threshold:   budget.Threshold,
+	}
+	if usage.Threshold <= 0 {
+		usage.Threshold = 0.9
+	}
+
+	summary, err := store.Summary(ResultFilter{From: start, Interface: uplink})
+	if err != nil {
+		return nil, fmt.Errorf("查询流量用量失败: %v", err)
+	}
+	usage.Used = summary.BytesUsed
+
+	// 使用相同测速模式最近5轮测速的平均用量作为估算值
+	mode, err = parseMode(mode)
+	if err != nil {
+		return nil, err
+	}
+	records, err := store.Query(ResultFilter{Mode: mode, Interface: uplink, Limit: estimateRecordLimit})
+	if err != nil {
+		return nil, fmt.Errorf("估算测速用量失败: %v", err)
+	}
+	// 记录按时间从新到旧排列，按轮次累加用量；达到查询上限时最后一轮可能不完整，不参与估算
+	var runIDs []string
+	totals := map[string]int64{}
+	for _, record := range records {
+		if record.RunID == nil {
+			continue
+		}
+		if _, ok := totals[*record.RunID]; !ok {
+			runIDs = append(runIDs, *record.RunID)
+		}
+		totals[*record.RunID] += intValue(record.BytesUsed)
+	}
+	if len(records) == estimateRecordLimit && len(runIDs) > 0 {
+		runIDs = runIDs[:len(runIDs)-1]
+	}
+	var sum, count int64
+	for _, runID := range runIDs {
+		if totals[runID] <= 0 {
+			continue
+		}
+		sum += totals[runID]
+		count++
+		if count == 5 {
+			break
+		}
+	}
+	if count > 0 {
+		usage.Estimate = sum / count
+	}
+	return usage, nil
+}
+
+// 自动测速前检查流量预算：全局预算统计所有测速的用量，出口单独设置的预算只统计该出口的用量。
+// 接近任一上限时按其处理方式降级为只测试延迟，或返回false表示跳过本次测速；reason说明原因
+func applyDataBudget(opts MeasureOptions, now time.Time) (MeasureOptions, bool, string, error) {
+	type scopedBudget struct {
+		uplink string
+		budget DataBudgetConfig
+	}
+	budgets := []scopedBudget{{"", config.DataBudget}}
+	if uplink, ok := config.findUplink(opts.Interface); ok && len(config.Uplinks) > 0 {
+		budgets = append(budgets, scopedBudget{uplink.label(), uplink.DataBudget})
+	}
+
+	// 按配置的测速模式估算用量，不受前一个预算降级的影响
+	mode := opts.Mode
+	reason := ""
+	for _, b := range budgets {
+		if b.budget.MonthlyMB <= 0 {
+			continue
+		}
+		usage, err := queryDataUsage(b.budget, b.uplink, mode, now)
+		if err != nil {
+			return opts, true, "", err
+		}
+		if !usage.near() {
+			continue
+		}
+
+		scope := "本月"
+		if b.uplink != "" {
+			scope = fmt.Sprintf("出口%s本月", b.uplink)
+		}
+		reason = fmt.Sprintf("%s已用流量%s，上限%s", scope, formatBytes(usage.Used), formatBytes(usage.Budget))
+		if b.budget.action() == BudgetActionSkip {
+			return opts, false, reason, nil
+		}
+		opts.Mode = ModePing
+	}
+	return opts, true, reason, nil
+}
+
+// 返回本计费周期的流量用量和预算；指定了出口时返回该出口的用量和单独设置的预算，否则返回所有测速的用量和全局预算
+func dataUsageHandler(w http.ResponseWriter, r *http.Request) {
+	uplink := r.URL.Query().Get("interface")
+	budget := config.DataBudget
+	if uplink != "" {
+		budget = DataBudgetConfig{}
+		if u, ok := config.findUplink(uplink); ok {
+			budget = u.DataBudget
+		}
+	}
+
+	usage, err := queryDataUsage(budget, uplink, config.Mode, time.Now())
+	if err != nil {
+		log.Printf("%v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"interface":       uplink,
+		"period_start":    usage.PeriodStart.Format("2006-01-02"),
+		"period_end":      usage.PeriodEnd.AddDate(0, 0, -1).Format("2006-01-02"), // 周期的最后一天
+		"used_bytes":      usage.Used,
+		"budget_bytes":    usage.Budget,
+		"remaining_bytes": usage.remaining(),
+		"estimate_bytes":  usage.Estimate,
+		"near_limit":      usage.near(),
+		"action":          budget.action(),
+	})
+}
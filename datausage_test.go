@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDataBudgetPeriod(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := func(year int, month time.Month, day, hour int, loc *time.Location) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, loc)
+	}
+
+	tests := []struct {
+		name       string
+		resetDay   int
+		now        time.Time
+		start, end time.Time
+	}{
+		{"默认每月1日", 0, date(2024, 5, 17, 12, time.UTC), date(2024, 5, 1, 0, time.UTC), date(2024, 6, 1, 0, time.UTC)},
+		{"结算日当天0点", 15, date(2024, 5, 15, 0, time.UTC), date(2024, 5, 15, 0, time.UTC), date(2024, 6, 15, 0, time.UTC)},
+		{"结算日之后", 15, date(2024, 5, 20, 8, time.UTC), date(2024, 5, 15, 0, time.UTC), date(2024, 6, 15, 0, time.UTC)},
+		{"结算日之前属于上个周期", 15, date(2024, 5, 14, 23, time.UTC), date(2024, 4, 15, 0, time.UTC), date(2024, 5, 15, 0, time.UTC)},
+		{"跨年", 10, date(2024, 1, 5, 0, time.UTC), date(2023, 12, 10, 0, time.UTC), date(2024, 1, 10, 0, time.UTC)},
+		{"闰年2月", 28, date(2024, 3, 1, 0, time.UTC), date(2024, 2, 28, 0, time.UTC), date(2024, 3, 28, 0, time.UTC)},
+		// 周期按本地时间的0点划分，跨越夏令时切换时周期长度不是整数天×24小时
+		{"跨越夏令时", 1, date(2024, 3, 20, 12, newYork), date(2024, 3, 1, 0, newYork), date(2024, 4, 1, 0, newYork)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := DataBudgetConfig{ResetDay: tt.resetDay}.period(tt.now)
+			if !start.Equal(tt.start) || !end.Equal(tt.end) {
+				t.Errorf("period(%v) = %v – %v, want %v – %v", tt.now, start, end, tt.start, tt.end)
+			}
+			if tt.now.Before(start) || !tt.now.Before(end) {
+				t.Errorf("%v 不在周期 %v – %v 内", tt.now, start, end)
+			}
+		})
+	}
+}
+
+func TestDataBudgetValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		budget  DataBudgetConfig
+		wantErr bool
+	}{
+		{"默认", DataBudgetConfig{}, false},
+		{"完整配置", DataBudgetConfig{MonthlyMB: 10240, ResetDay: 28, Threshold: 0.8, Action: BudgetActionSkip}, false},
+		{"上限为负数", DataBudgetConfig{MonthlyMB: -1}, true},
+		{"结算日超过28日", DataBudgetConfig{ResetDay: 29}, true},
+		{"阈值超过1", DataBudgetConfig{Threshold: 1.5}, true},
+		{"未知的处理方式", DataBudgetConfig{Action: "stop"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.budget.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDataUsageNear(t *testing.T) {
+	tests := []struct {
+		name  string
+		usage dataUsage
+		want  bool
+	}{
+		{"不限制", dataUsage{Used: 1 << 40, Threshold: 0.9}, false},
+		{"未达到阈值", dataUsage{Budget: 1000, Used: 500, Threshold: 0.9, Estimate: 100}, false},
+		{"达到阈值", dataUsage{Budget: 1000, Used: 900, Threshold: 0.9}, true},
+		{"剩余不足一轮测速", dataUsage{Budget: 1000, Used: 500, Threshold: 0.9, Estimate: 501}, true},
+		{"已超出上限", dataUsage{Budget: 1000, Used: 1200, Threshold: 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.usage.near(); got != tt.want {
+				t.Errorf("near() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// 指定数据库路径的环境变量
+const dbPathEnv = "SPEED_DB"
+
+// 数据库文件名
+const dbFileName = "results.db"
+
+// 按优先级确定数据库路径：命令行参数、环境变量、配置文件，都未指定时使用数据目录下的默认路径。
+// 返回路径和来源的说明
+func resolveDBPath(flagValue, configValue string) (string, string, error) {
+	switch {
+	case flagValue != "":
+		return flagValue, "命令行参数 -db", nil
+	case os.Getenv(dbPathEnv) != "":
+		return os.Getenv(dbPathEnv), "环境变量 " + dbPathEnv, nil
+	case configValue != "":
+		return configValue, "配置文件 db_path", nil
+	}
+
+	dir, err := dataDir()
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(dir, dbFileName), "默认数据目录", nil
+}
+
+// 数据目录：$XDG_DATA_HOME/speed，未设置时为 ~/.local/share/speed；Windows为 %LOCALAPPDATA%\speed
+func dataDir() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "speed"), nil
+	}
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+			return filepath.Join(dir, "speed"), nil
+		}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("无法确定数据目录，请通过 -db 或环境变量%s指定数据库路径: %v", dbPathEnv, err)
+	}
+	return filepath.Join(home, ".local", "share", "speed"), nil
+}
+
+// 旧版本把数据库放在源码目录，通常与程序或当前目录相同。默认路径还没有数据库而这些位置有时给出提示，
+// 不自动迁移，以免误用其他程序的results.db
+func warnLegacyDatabase(path string) {
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	var candidates []string
+	if exe, err := os.Executable(); err == nil {
+		candidates = append(candidates, filepath.Join(filepath.Dir(exe), dbFileName))
+	}
+	if wd, err := os.Getwd(); err == nil {
+		candidates = append(candidates, filepath.Join(wd, dbFileName))
+	}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			log.Printf("发现旧版本位置的数据库%s，如需继续使用请通过 -db 指定，或将其移动到%s", candidate, path)
+			return
+		}
+	}
+}
+
+// -db-info：输出数据库的路径、大小、版本和各表的记录数
+func printDBInfo(source string) {
+	fmt.Printf("数据库: %s\n来源: %s\n", DBPath, source)
+	info, err := os.Stat(DBPath)
+	if os.IsNotExist(err) {
+		fmt.Println("数据库文件不存在，首次测速时创建")
+		return
+	}
+	if err != nil {
+		log.Fatalf("读取数据库文件失败: %v", err)
+	}
+	fmt.Printf("大小: %s\n", formatBytes(info.Size()))
+
+	db, err := openDatabase()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer db.Close()
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	fmt.Printf("版本: %d（最新版本%d）\n", version, latestSchemaVersion())
+
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		log.Fatalf("查询数据表失败: %v", err)
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			log.Fatalf("扫描数据表失败: %v", err)
+		}
+		tables = append(tables, name)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("遍历数据表失败: %v", err)
+	}
+	rows.Close()
+
+	fmt.Println("\n记录数:")
+	for _, table := range tables {
+		var count int64
+		if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", table)).Scan(&count); err != nil {
+			log.Fatalf("统计%s的记录数失败: %v", table, err)
+		}
+		fmt.Printf("  %-22s %d\n", table, count)
+	}
+
+	// 版本5之前的时间不是时间戳，不输出时间范围
+	if version < 5 {
+		return
+	}
+	var first, last sql.NullInt64
+	if err := db.QueryRow("SELECT MIN(test_time), MAX(test_time) FROM speedtest_results").Scan(&first, &last); err != nil {
+		log.Fatalf("查询测速时间范围失败: %v", err)
+	}
+	if first.Valid {
+		fmt.Printf("\n测速记录时间: %s 至 %s\n", formatLocalTime(first.Int64), formatLocalTime(last.Int64))
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 未配置时使用的默认测试域名和DNS服务器
+var (
+	defaultDNSBenchDomains = []string{
+		"www.baidu.com",
+		"www.qq.com",
+		"www.taobao.com",
+		"www.bilibili.com",
+		"github.com",
+	}
+	defaultDNSBenchResolvers = []string{
+		"udp://223.5.5.5",
+		"udp://119.29.29.29",
+		"tcp://223.5.5.5",
+		"tls://dns.alidns.com",
+		"https://doh.pub/dns-query",
+	}
+)
+
+// 被测试的DNS服务器，支持以下格式：
+//
+//	system                    系统解析器
+//	udp://host[:port]         传统DNS（默认端口53）
+//	tcp://host[:port]         DNS over TCP（默认端口53）
+//	tls://host[:port]         DNS over TLS（默认端口853）
+//	https://host/path         DNS over HTTPS（RFC 8484，POST方式）
+//
+// TCP、TLS和HTTPS在同一轮测试中复用连接，第一个域名的查询时间包含建立连接的时间
+type dnsResolver struct {
+	raw    string
+	scheme string
+	addr   string
+	host   string // TLS证书校验使用的主机名
+
+	conn   net.Conn     // tcp和tls复用的连接
+	client *http.Client // https使用的客户端
+}
+
+// 解析DNS服务器配置
+func parseDNSResolver(raw string) (*dnsResolver, error) {
+	if raw == "system" {
+		return &dnsResolver{raw: raw, scheme: raw}, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("无效的DNS服务器%s: %v", raw, err)
+	}
+	r := &dnsResolver{raw: raw, scheme: u.Scheme, host: u.Hostname()}
+	if r.host == "" {
+		return nil, fmt.Errorf("DNS服务器%s缺少主机名", raw)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		host, port := splitHostPort(u.Host, "53")
+		r.addr = net.JoinHostPort(host, port)
+	case "tls":
+		host, port := splitHostPort(u.Host, "853")
+		r.addr = net.JoinHostPort(host, port)
+	case "https":
+		r.client = &http.Client{Transport: &http.Transport{Proxy: outboundProxy, DialContext: outboundDialContext}}
+	default:
+		return nil, fmt.Errorf("不支持的DNS服务器%s，仅支持system、udp、tcp、tls和https", raw)
+	}
+	return r, nil
+}
+
+// 解析一个域名并返回耗时，查询A记录
+func (r *dnsResolver) lookup(ctx context.Context, domain string) (time.Duration, error) {
+	start := time.Now()
+	if r.scheme == "system" {
+		if _, err := net.DefaultResolver.LookupIP(ctx, "ip4", domain); err != nil {
+			return 0, err
+		}
+		return time.Since(start), nil
+	}
+
+	id := uint16(rand.Uint32())
+	query, err := buildDNSQuery(id, domain)
+	if err != nil {
+		return 0, err
+	}
+	var response []byte
+	switch r.scheme {
+	case "udp":
+		response, err = r.exchangeUDP(ctx, id, query)
+	case "tcp", "tls":
+		response, err = r.exchangeStream(ctx, query)
+	case "https":
+		response, err = r.exchangeHTTPS(ctx, query)
+	}
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	if err := checkDNSResponse(id, response); err != nil {
+		return 0, err
+	}
+	return elapsed, nil
+}
+
+// UDP查询无法经过代理，只绑定出口
+func (r *dnsResolver) exchangeUDP(ctx context.Context, id uint16, query []byte) ([]byte, error) {
+	conn, err := outboundDialContext(ctx, "udp", r.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// 忽略ID不匹配的迟到响应
+		if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+			return buf[:n], nil
+		}
+	}
+}
+
+// TCP和TLS使用两字节长度前缀，出错时关闭连接，下一次查询重新建立
+func (r *dnsResolver) exchangeStream(ctx context.Context, query []byte) ([]byte, error) {
+	if r.conn == nil {
+		conn, err := dialOutboundTCP(ctx, r.addr)
+		if err != nil {
+			return nil, err
+		}
+		if r.scheme == "tls" {
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: r.host})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		}
+		r.conn = conn
+	}
+
+	response, err := r.roundTrip(ctx, query)
+	if err != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+	return response, err
+}
+
+func (r *dnsResolver) roundTrip(ctx context.Context, query []byte) ([]byte, error) {
+	deadline, _ := ctx.Deadline()
+	r.conn.SetDeadline(deadline)
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := r.conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(r.conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r.conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (r *dnsResolver) exchangeHTTPS(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.raw, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH服务器返回HTTP %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// 释放复用的连接
+func (r *dnsResolver) close() {
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+	if r.client != nil {
+		r.client.CloseIdleConnections()
+	}
+}
+
+// 构造查询A记录的DNS请求报文
+func buildDNSQuery(id uint16, domain string) ([]byte, error) {
+	msg := make([]byte, 12, 12+len(domain)+6)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // RD：请求递归查询
+	binary.BigEndian.PutUint16(msg[4:], 1)      // QDCOUNT
+
+	for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, fmt.Errorf("无效的域名: %s", domain)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, 1) // QTYPE A
+	msg = binary.BigEndian.AppendUint16(msg, 1) // QCLASS IN
+	return msg, nil
+}
+
+// DNS响应码对应的名称
+var dnsRcodeNames = map[uint16]string{
+	1: "FORMERR",
+	2: "SERVFAIL",
+	3: "NXDOMAIN",
+	4: "NOTIMP",
+	5: "REFUSED",
+}
+
+// 检查响应报文的ID和响应码
+func checkDNSResponse(id uint16, response []byte) error {
+	if len(response) < 12 {
+		return fmt.Errorf("DNS响应过短")
+	}
+	if binary.BigEndian.Uint16(response) != id {
+		return fmt.Errorf("DNS响应ID不匹配")
+	}
+	flags := binary.BigEndian.Uint16(response[2:])
+	if flags&0x8000 == 0 {
+		return fmt.Errorf("收到的不是DNS响应")
+	}
+	if rcode := flags & 0x000f; rcode != 0 {
+		name, ok := dnsRcodeNames[rcode]
+		if !ok {
+			name = strconv.Itoa(int(rcode))
+		}
+		return fmt.Errorf("DNS服务器返回%s", name)
+	}
+	return nil
+}
+
+// 一次DNS查询的结果
+type dnsLookupResult struct {
+	Resolver string
+	Domain   string
+	Duration time.Duration
+	Err      error
+}
+
+// 一个DNS服务器在一轮测试中的汇总
+type dnsResolverSummary struct {
+	Resolver string
+	Median   time.Duration
+	Min      time.Duration
+	Max      time.Duration
+	Failures int
+	Total    int
+	Err      error // 最后一次失败的原因
+}
+
+// 一轮DNS测试的结果
+type DNSBenchResult struct {
+	RunID     string
+	TestTime  time.Time
+	Lookups   []dnsLookupResult
+	Summaries []dnsResolverSummary
+}
+
+// 依次用每个DNS服务器解析所有域名，系统解析器总是第一个参与比较
+func runDNSBench(ctx context.Context, cfg DNSBenchConfig) (*DNSBenchResult, error) {
+	domains := cfg.Domains
+	if len(domains) == 0 {
+		domains = defaultDNSBenchDomains
+	}
+	rawResolvers := cfg.Resolvers
+	if len(rawResolvers) == 0 {
+		rawResolvers = defaultDNSBenchResolvers
+	}
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+
+	resolvers := []*dnsResolver{{raw: "system", scheme: "system"}}
+	for _, raw := range rawResolvers {
+		if raw == "system" {
+			continue
+		}
+		resolver, err := parseDNSResolver(raw)
+		if err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, resolver)
+	}
+	if config.Proxy != "" {
+		for _, resolver := range resolvers {
+			if resolver.scheme == "system" || resolver.scheme == "udp" {
+				warnOnce("dns "+resolver.raw, "DNS服务器%s使用UDP查询，无法经过代理，将直接连接", resolver.raw)
+			}
+		}
+	}
+
+	bench := &DNSBenchResult{RunID: newRunID(), TestTime: time.Now()}
+	for _, resolver := range resolvers {
+		summary := dnsResolverSummary{Resolver: resolver.raw}
+		var durations []time.Duration
+		for _, domain := range domains {
+			if ctx.Err() != nil {
+				resolver.close()
+				return bench, fmt.Errorf("DNS测试已取消: %w", ctx.Err())
+			}
+
+			lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+			duration, err := resolver.lookup(lookupCtx, domain)
+			cancel()
+			bench.Lookups = append(bench.Lookups, dnsLookupResult{Resolver: resolver.raw, Domain: domain, Duration: duration, Err: err})
+			summary.Total++
+			if err != nil {
+				summary.Failures++
+				summary.Err = err
+				continue
+			}
+			durations = append(durations, duration)
+		}
+		resolver.close()
+
+		if len(durations) > 0 {
+			sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+			summary.Min = durations[0]
+			summary.Median = medianDuration(durations)
+			summary.Max = durations[len(durations)-1]
+		}
+		bench.Summaries = append(bench.Summaries, summary)
+	}
+	return bench, nil
+}
+
+// 执行一轮DNS测试并保存结果
+func runDNSBenchAndSave(ctx context.Context, cfg DNSBenchConfig) (*DNSBenchResult, error) {
+	bench, err := runDNSBench(ctx, cfg)
+	if bench == nil || len(bench.Lookups) == 0 {
+		return bench, err
+	}
+	if saveErr := saveDNSBench(bench); saveErr != nil {
+		return bench, saveErr
+	}
+	return bench, err
+}
+
+// 保存一轮DNS测试的每次查询结果，失败的查询耗时为NULL
+func saveDNSBench(bench *DNSBenchResult) error {
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("开启事务失败: %v", err)
+	}
+	defer tx.Rollback()
+
+	testTime := bench.TestTime.Unix()
+	for _, lookup := range bench.Lookups {
+		var duration, errorMessage interface{}
+		if lookup.Err != nil {
+			errorMessage = lookup.Err.Error()
+		} else {
+			duration = durationMs(lookup.Duration)
+		}
+		_, err := tx.Exec("INSERT INTO dns_results (run_id, resolver, domain, duration, error_message, test_time) VALUES (?, ?, ?, ?, ?, ?)",
+			bench.RunID, lookup.Resolver, lookup.Domain, duration, errorMessage, testTime)
+		if err != nil {
+			return fmt.Errorf("插入DNS测试结果失败: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("提交事务失败: %v", err)
+	}
+	return nil
+}
+
+// 输出一轮DNS测试的汇总
+func printDNSBench(bench *DNSBenchResult) {
+	fmt.Printf("%-35s %-12s %-12s %-12s %-8s\n", "DNS服务器", "中位数(ms)", "最快(ms)", "最慢(ms)", "失败")
+	fmt.Println("-----------------------------------------------------------------------------------")
+	for _, summary := range bench.Summaries {
+		if summary.Failures == summary.Total {
+			fmt.Printf("%-35s %-12s %-12s %-12s %d/%d\n", summary.Resolver, "-", "-", "-", summary.Failures, summary.Total)
+		} else {
+			fmt.Printf("%-35s %-12.1f %-12.1f %-12.1f %d/%d\n", summary.Resolver,
+				durationMs(summary.Median), durationMs(summary.Min), durationMs(summary.Max), summary.Failures, summary.Total)
+		}
+		if summary.Err != nil {
+			fmt.Printf("      失败原因: %v\n", summary.Err)
+		}
+	}
+}
+
+// 定期执行DNS测试，ctx结束时停止
+func autoDNSBench(ctx context.Context, cfg DNSBenchConfig) {
+	ticker := time.NewTicker(time.Duration(cfg.Interval) * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := runDNSBenchAndSave(ctx, cfg); err != nil {
+				log.Printf("DNS测试失败: %v", err)
+			}
+		}
+	}
+}
+
+// 获取最近limit轮DNS测试中每个DNS服务器的查询耗时中位数和失败次数
+func dnsBenchHandler(limit int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db, err := openDatabase()
+		if err != nil {
+			log.Printf("%v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer db.Close()
+
+		rows, err := db.Query(`
+		SELECT run_id, test_time, resolver, duration
+		FROM dns_results WHERE run_id IN (
+			SELECT run_id FROM dns_results GROUP BY run_id ORDER BY MAX(test_time) DESC LIMIT ?
+		) ORDER BY test_time, id`, limit)
+		if err != nil {
+			log.Printf("查询DNS测试结果失败: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		// 按轮次和DNS服务器分组，保持查询顺序
+		var runIDs, resolvers []string
+		timestamps := map[string]string{}
+		durations := map[string]map[string][]time.Duration{}
+		failures := map[string]map[string]int{}
+		for rows.Next() {
+			var runID, resolver string
+			var testTime int64
+			var duration sql.NullFloat64
+			if err := rows.Scan(&runID, &testTime, &resolver, &duration); err != nil {
+				log.Printf("扫描数据失败: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if _, ok := durations[runID]; !ok {
+				runIDs = append(runIDs, runID)
+				timestamps[runID] = formatAPITime(testTime)
+				durations[runID] = map[string][]time.Duration{}
+				failures[runID] = map[string]int{}
+			}
+			if !slices.Contains(resolvers, resolver) {
+				resolvers = append(resolvers, resolver)
+			}
+			if !duration.Valid {
+				failures[runID][resolver]++
+				continue
+			}
+			durations[runID][resolver] = append(durations[runID][resolver], time.Duration(duration.Float64*float64(time.Millisecond)))
+		}
+
+		// 每个DNS服务器一条曲线，某轮没有测试该服务器或全部失败时为null
+		timestampList := []string{}
+		for _, runID := range runIDs {
+			timestampList = append(timestampList, timestamps[runID])
+		}
+		series := []map[string]interface{}{}
+		for _, resolver := range resolvers {
+			medians := []interface{}{}
+			failureCounts := []int{}
+			for _, runID := range runIDs {
+				if values := durations[runID][resolver]; len(values) > 0 {
+					medians = append(medians, durationMs(medianDuration(values)))
+				} else {
+					medians = append(medians, nil)
+				}
+				failureCounts = append(failureCounts, failures[runID][resolver])
+			}
+			series = append(series, map[string]interface{}{
+				"resolver": resolver,
+				"median":   medians,
+				"failures": failureCounts,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"timestamps": timestampList,
+			"resolvers":  series,
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildDNSQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		domain  string
+		want    []byte // 问题部分
+		wantErr bool
+	}{
+		{"普通域名", "www.example.com", []byte("\x03www\x07example\x03com\x00\x00\x01\x00\x01"), false},
+		{"末尾的点", "example.com.", []byte("\x07example\x03com\x00\x00\x01\x00\x01"), false},
+		{"单个标签", "localhost", []byte("\x09localhost\x00\x00\x01\x00\x01"), false},
+		{"63字节的标签", strings.Repeat("a", 63) + ".com", append(append([]byte{63}, strings.Repeat("a", 63)...), "\x03com\x00\x00\x01\x00\x01"...), false},
+		{"标签过长", strings.Repeat("a", 64) + ".com", nil, true},
+		{"空标签", "www..com", nil, true},
+		{"空域名", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := buildDNSQuery(0x1234, tt.domain)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("buildDNSQuery(%q) 应返回错误", tt.domain)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			header := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+			if !bytes.Equal(query[:12], header) {
+				t.Errorf("报文头 = % x, want % x", query[:12], header)
+			}
+			if !bytes.Equal(query[12:], tt.want) {
+				t.Errorf("问题部分 = %q, want %q", query[12:], tt.want)
+			}
+		})
+	}
+}
+
+// 构造响应报文头，flags包括QR位和响应码
+func dnsResponseHeader(id, flags uint16) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg, id)
+	binary.BigEndian.PutUint16(msg[2:], flags)
+	return msg
+}
+
+func TestCheckDNSResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		response []byte
+		wantErr  string
+	}{
+		{"成功", dnsResponseHeader(0x1234, 0x8180), ""},
+		{"过短", dnsResponseHeader(0x1234, 0x8180)[:11], "DNS响应过短"},
+		{"ID不匹配", dnsResponseHeader(0x4321, 0x8180), "DNS响应ID不匹配"},
+		{"不是响应", dnsResponseHeader(0x1234, 0x0100), "收到的不是DNS响应"},
+		{"NXDOMAIN", dnsResponseHeader(0x1234, 0x8183), "DNS服务器返回NXDOMAIN"},
+		{"SERVFAIL", dnsResponseHeader(0x1234, 0x8182), "DNS服务器返回SERVFAIL"},
+		{"未知响应码", dnsResponseHeader(0x1234, 0x8189), "DNS服务器返回9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDNSResponse(0x1234, tt.response)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkDNSResponse() = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("checkDNSResponse() = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseDNSResolver(t *testing.T) {
+	tests := []struct {
+		raw      string
+		wantAddr string
+		wantErr  bool
+	}{
+		{"udp://223.5.5.5", "223.5.5.5:53", false},
+		{"tcp://223.5.5.5:5353", "223.5.5.5:5353", false},
+		{"tls://dns.alidns.com", "dns.alidns.com:853", false},
+		{"udp://[2400:3200::1]", "[2400:3200::1]:53", false},
+		{"https://doh.pub/dns-query", "", false},
+		{"quic://dns.alidns.com", "", true},
+		{"udp://", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			r, err := parseDNSResolver(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDNSResolver(%q) = %v, wantErr %v", tt.raw, err, tt.wantErr)
+			}
+			if err == nil && r.addr != tt.wantAddr {
+				t.Errorf("地址 = %s, want %s", r.addr, tt.wantAddr)
+			}
+		})
+	}
+}
+
+// 对任意查询返回响应码为rcode的响应
+func dnsAnswer(query []byte, rcode uint16) []byte {
+	response := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(response[2:], 0x8180|rcode)
+	return response
+}
+
+// 通过本机的UDP和TCP DNS服务器测试完整的查询过程
+func TestDNSResolverLookup(t *testing.T) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// 先发送一个ID不匹配的迟到响应，应被忽略
+			stale := dnsAnswer(buf[:n], 0)
+			stale[0]++
+			udp.WriteTo(stale, addr)
+			udp.WriteTo(dnsAnswer(buf[:n], 0), addr)
+		}
+	}()
+
+	tcpAddr := listenTest(t, func(conn net.Conn) {
+		for {
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			var rcode uint16
+			if bytes.Contains(query, []byte("\x07missing")) {
+				rcode = 3
+			}
+			response := dnsAnswer(query, rcode)
+			conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(response))))
+			conn.Write(response)
+		}
+	})
+
+	tests := []struct {
+		resolver string
+		domain   string
+		wantErr  bool
+	}{
+		{"udp://" + udp.LocalAddr().String(), "www.example.com", false},
+		{"tcp://" + tcpAddr, "www.example.com", false},
+		{"tcp://" + tcpAddr, "missing.example.com", true},
+		// 上一次查询失败后连接仍可复用
+		{"tcp://" + tcpAddr, "example.com", false},
+	}
+	resolvers := map[string]*dnsResolver{}
+	for _, tt := range tests {
+		r := resolvers[tt.resolver]
+		if r == nil {
+			if r, err = parseDNSResolver(tt.resolver); err != nil {
+				t.Fatal(err)
+			}
+			resolvers[tt.resolver] = r
+			defer r.close()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		_, err := r.lookup(ctx, tt.domain)
+		cancel()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s解析%s: %v, wantErr %v", tt.resolver, tt.domain, err, tt.wantErr)
+		}
+	}
+}
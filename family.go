@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 地址族选项，同时也是保存到speedtest_results.ip_family的值
+const (
+	FamilyAuto = ""     // 由系统解析和连接结果决定
+	FamilyIPv4 = "v4"   // 只使用IPv4
+	FamilyIPv6 = "v6"   // 只使用IPv6
+	FamilyBoth = "both" // IPv4和IPv6各测一次
+)
+
+// 根据地址族选项返回一轮测速需要依次测试的地址族
+func measureFamilies(family string) ([]string, error) {
+	switch family {
+	case FamilyAuto, FamilyIPv4, FamilyIPv6:
+		return []string{family}, nil
+	case FamilyBoth:
+		return []string{FamilyIPv4, FamilyIPv6}, nil
+	default:
+		return nil, fmt.Errorf("未知的地址族: %s，仅支持v4、v6和both", family)
+	}
+}
+
+// 地址族的显示名称，未知时为"-"
+func familyName(family string) string {
+	switch family {
+	case FamilyIPv4:
+		return "IPv4"
+	case FamilyIPv6:
+		return "IPv6"
+	default:
+		return "-"
+	}
+}
+
+// 返回IP地址所属的地址族
+func familyOf(ip net.IP) string {
+	if ip == nil {
+		return FamilyAuto
+	}
+	if ip.To4() != nil {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+// 为tcp、udp、ip等网络名称加上地址族后缀，如 tcp4、ip6
+func familyNetwork(network, family string) string {
+	switch family {
+	case FamilyIPv4:
+		return network + "4"
+	case FamilyIPv6:
+		return network + "6"
+	default:
+		return network
+	}
+}
+
+// 返回只允许连接指定地址族的net.Dialer控制函数，未指定地址族时返回nil
+//
+// 拨号时会依次尝试域名解析出的每个地址，控制函数拒绝的地址视为连接失败，
+// 因此即使调用方使用tcp或udp网络，也只会连接到指定地址族的地址
+func familyControl(family string) func(network, address string, c syscall.RawConn) error {
+	if family != FamilyIPv4 && family != FamilyIPv6 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		// network为解析后的具体网络，如 tcp4、udp6
+		network, _, _ = strings.Cut(network, ":")
+		if !strings.HasSuffix(network, strings.TrimPrefix(family, "v")) {
+			return fmt.Errorf("地址%s不是%s地址", address, familyName(family))
+		}
+		return nil
+	}
+}
+
+// 返回测速使用的net.Dialer：只连接指定地址族的地址，source不为nil时绑定到该源地址
+func outboundDialer(family string, source *sourceAddr, timeout time.Duration) *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control:   familyControl(family),
+	}
+	if source != nil {
+		familyCheck := dialer.Control
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			if familyCheck != nil {
+				if err := familyCheck(network, address, c); err != nil {
+					return err
+				}
+			}
+			return source.control(network, address, c)
+		}
+	}
+	return dialer
+}
+
+// 记录最近一次建立的连接所使用的地址族，用于在未指定地址族时得知实际使用的地址族
+type familyRecorder struct {
+	sync.Mutex
+	family string
+}
+
+// 包装拨号函数，连接成功时记录远端地址的地址族
+func (r *familyRecorder) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			r.Lock()
+			r.family = familyOf(tcpAddr.IP)
+			r.Unlock()
+		}
+		return conn, nil
+	}
+}
+
+// 返回最近一次连接的地址族，尚未建立连接时为空
+func (r *familyRecorder) get() string {
+	r.Lock()
+	defer r.Unlock()
+	return r.family
+}
+
+// 通过icanhazip.com获取本机指定地址族的公网IP，没有该地址族的网络时返回错误
+// 与测速使用相同的出口和代理，查询到的是测速时的公网IP
+func publicIP(ctx context.Context, family string, opts MeasureOptions) (string, error) {
+	source, err := parseSource(opts.Source)
+	if err != nil {
+		return "", err
+	}
+	proxy, err := parseProxy(opts.Proxy)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			Proxy:       proxyFunc(proxy),
+			DialContext: outboundDialer(family, source, 5*time.Second).DialContext,
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://icanhazip.com/", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("获取%s公网IP失败: %v", familyName(family), err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", fmt.Errorf("获取%s公网IP失败: %v", familyName(family), err)
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil || familyOf(ip) != family {
+		return "", fmt.Errorf("获取%s公网IP失败: 无效的响应", familyName(family))
+	}
+	return ip.String(), nil
+}
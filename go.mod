@@ -3,6 +3,7 @@ module speed
 go 1.24.3
 
 require (
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.30
 	github.com/showwin/speedtest-go v1.7.10
 )
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// 未配置时使用的默认探测地址
+var defaultHTTPProbeURLs = []string{
+	"https://www.baidu.com/",
+	"https://www.qq.com/",
+	"https://github.com/",
+}
+
+// 页面最多读取的字节数，避免误配置大文件时占满带宽
+const httpProbeMaxBytes = 10 << 20
+
+// 一次HTTP探测的各阶段耗时，DNS、连接和TLS在复用连接或使用IP地址时为0
+type HTTPProbeResult struct {
+	URL        string
+	TestTime   time.Time
+	StatusCode int
+	DNS        time.Duration
+	Connect    time.Duration
+	TLS        time.Duration
+	TTFB       time.Duration // 从发起请求到收到响应第一个字节
+	Total      time.Duration // 从发起请求到读完响应
+	Bytes      int64
+	Err        error
+}
+
+// 探测一个地址，每次使用新连接，不跟随重定向
+func probeHTTP(ctx context.Context, url string) *HTTPProbeResult {
+	result := &HTTPProbeResult{URL: url, TestTime: time.Now()}
+
+	// 双栈时IPv4和IPv6可能并发建立连接，回调需要加锁
+	var mu sync.Mutex
+	var dnsStart, connectStart, tlsStart, firstByte time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			result.DNS = time.Since(dnsStart)
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			defer mu.Unlock()
+			if connectStart.IsZero() {
+				connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil && result.Connect == 0 {
+				result.Connect = time.Since(connectStart)
+			}
+		},
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			result.TLS = time.Since(tlsStart)
+		},
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, url, nil)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; speed-probe)")
+
+	transport := &http.Transport{DisableKeepAlives: true, Proxy: outboundProxy, DialContext: outboundDialContext}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer resp.Body.Close()
+	result.TTFB = firstByte.Sub(start)
+	result.StatusCode = resp.StatusCode
+
+	result.Bytes, err = io.Copy(io.Discard, io.LimitReader(resp.Body, httpProbeMaxBytes))
+	result.Total = time.Since(start)
+	if err != nil {
+		result.Err = fmt.Errorf("读取响应失败: %v", err)
+	}
+	return result
+}
+
+// 依次探测所有配置的地址并保存结果
+func runHTTPProbes(ctx context.Context, cfg HTTPProbeConfig) ([]*HTTPProbeResult, error) {
+	urls := cfg.URLs
+	if len(urls) == 0 {
+		urls = defaultHTTPProbeURLs
+	}
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	var results []*HTTPProbeResult
+	for _, url := range urls {
+		if ctx.Err() != nil {
+			return results, fmt.Errorf("HTTP探测已取消: %w", ctx.Err())
+		}
+		probeCtx, cancel := context.WithTimeout(ctx, timeout)
+		result := probeHTTP(probeCtx, url)
+		cancel()
+		if err := saveHTTPProbe(result); err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// 保存一次HTTP探测结果，失败时未完成阶段的耗时为NULL
+func saveHTTPProbe(result *HTTPProbeResult) error {
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var statusCode, ttfb, total, errorMessage interface{}
+	if result.StatusCode != 0 {
+		statusCode = result.StatusCode
+		ttfb = durationMs(result.TTFB)
+	}
+	if result.Err != nil {
+		errorMessage = result.Err.Error()
+	} else {
+		total = durationMs(result.Total)
+	}
+	_, err = db.Exec(`INSERT INTO http_probe_results (url, status_code, dns_time, connect_time, tls_time, ttfb, total_time, bytes, error_message, test_time)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		result.URL, statusCode, durationMs(result.DNS), durationMs(result.Connect), durationMs(result.TLS), ttfb, total, result.Bytes,
+		errorMessage, result.TestTime.Unix())
+	if err != nil {
+		return fmt.Errorf("插入HTTP探测结果失败: %v", err)
+	}
+	return nil
+}
+
+// 输出HTTP探测结果
+func printHTTPProbes(results []*HTTPProbeResult) {
+	fmt.Printf("%-40s %-6s %-10s %-10s %-10s %-10s %-10s %-10s\n", "地址", "状态", "DNS(ms)", "连接(ms)", "TLS(ms)", "首字节(ms)", "总耗时(ms)", "大小(KB)")
+	fmt.Println("-----------------------------------------------------------------------------------------------------------------")
+	for _, result := range results {
+		if result.StatusCode == 0 {
+			fmt.Printf("%-40s 失败: %v\n", result.URL, result.Err)
+			continue
+		}
+		fmt.Printf("%-40s %-6d %-10.1f %-10.1f %-10.1f %-10.1f %-10.1f %-10.1f\n", result.URL, result.StatusCode,
+			durationMs(result.DNS), durationMs(result.Connect), durationMs(result.TLS), durationMs(result.TTFB), durationMs(result.Total), float64(result.Bytes)/1024)
+		if result.Err != nil {
+			fmt.Printf("      失败原因: %v\n", result.Err)
+		}
+	}
+}
+
+// 列出数据库中的所有HTTP探测记录
+func listHTTPProbes() {
+	db, err := openDatabase()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, url, status_code, dns_time, connect_time, tls_time, ttfb, total_time, bytes, error_message, test_time FROM http_probe_results ORDER BY test_time DESC, id DESC")
+	if err != nil {
+		log.Fatalf("查询数据失败: %v", err)
+	}
+	defer rows.Close()
+
+	fmt.Printf("%-5s %-40s %-6s %-10s %-10s %-10s %-10s %-10s %-10s %-20s\n", "ID", "地址", "状态", "DNS(ms)", "连接(ms)", "TLS(ms)", "首字节(ms)", "总耗时(ms)", "大小(KB)", "测试时间")
+	fmt.Println("--------------------------------------------------------------------------------------------------------------------------------------------")
+
+	for rows.Next() {
+		var id int
+		var url string
+		var statusCode sql.NullInt64
+		var dnsTime, connectTime, tlsTime float64
+		var ttfb, totalTime sql.NullFloat64
+		var bytes, testTime int64
+		var errorMessage sql.NullString
+		if err := rows.Scan(&id, &url, &statusCode, &dnsTime, &connectTime, &tlsTime, &ttfb, &totalTime, &bytes, &errorMessage, &testTime); err != nil {
+			log.Fatalf("扫描数据失败: %v", err)
+		}
+
+		status := "-"
+		if statusCode.Valid {
+			status = fmt.Sprintf("%d", statusCode.Int64)
+		}
+		fmt.Printf("%-5d %-40s %-6s %-10.1f %-10.1f %-10.1f %-10s %-10s %-10.1f %-20s\n", id, url, status,
+			dnsTime, connectTime, tlsTime, formatNullFloat(ttfb), formatNullFloat(totalTime), float64(bytes)/1024, formatLocalTime(testTime))
+		if errorMessage.Valid {
+			fmt.Printf("      失败原因: %s\n", errorMessage.String)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Fatalf("遍历结果失败: %v", err)
+	}
+}
+
+// 定期执行HTTP探测，ctx结束时停止
+func autoHTTPProbe(ctx context.Context, cfg HTTPProbeConfig) {
+	ticker := time.NewTicker(time.Duration(cfg.Interval) * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := runHTTPProbes(ctx, cfg); err != nil {
+				log.Printf("HTTP探测失败: %v", err)
+			}
+		}
+	}
+}
+
+// 获取每个地址最近limit次HTTP探测的各阶段耗时，按时间从旧到新排列
+func httpProbesHandler(limit int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db, err := openDatabase()
+		if err != nil {
+			log.Printf("%v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer db.Close()
+
+		rows, err := db.Query(`
+		SELECT url, test_time, status_code, dns_time, connect_time, tls_time, ttfb, total_time, error_message
+		FROM (
+			SELECT *, ROW_NUMBER() OVER (PARTITION BY url ORDER BY test_time DESC, id DESC) AS n FROM http_probe_results
+		) WHERE n <= ? ORDER BY url, test_time, id`, limit)
+		if err != nil {
+			log.Printf("查询HTTP探测结果失败: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		// 按地址分组，查询结果已按地址排序
+		var urls []string
+		series := map[string]map[string][]interface{}{}
+		for rows.Next() {
+			var url string
+			var testTime int64
+			var statusCode sql.NullInt64
+			var dnsTime, connectTime, tlsTime float64
+			var ttfb, totalTime sql.NullFloat64
+			var errorMessage sql.NullString
+			if err := rows.Scan(&url, &testTime, &statusCode, &dnsTime, &connectTime, &tlsTime, &ttfb, &totalTime, &errorMessage); err != nil {
+				log.Printf("扫描数据失败: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			s, ok := series[url]
+			if !ok {
+				urls = append(urls, url)
+				s = map[string][]interface{}{}
+				series[url] = s
+			}
+			var status interface{}
+			if statusCode.Valid {
+				status = statusCode.Int64
+			}
+			s["timestamps"] = append(s["timestamps"], formatAPITime(testTime))
+			s["status"] = append(s["status"], status)
+			s["dns"] = append(s["dns"], dnsTime)
+			s["connect"] = append(s["connect"], connectTime)
+			s["tls"] = append(s["tls"], tlsTime)
+			s["ttfb"] = append(s["ttfb"], nullFloat(ttfb))
+			s["total"] = append(s["total"], nullFloat(totalTime))
+			s["errors"] = append(s["errors"], nullString(errorMessage))
+		}
+
+		result := []map[string]interface{}{}
+		for _, url := range urls {
+			s := series[url]
+			result = append(result, map[string]interface{}{
+				"url":        url,
+				"timestamps": s["timestamps"],
+				"status":     s["status"],
+				"dns":        s["dns"],
+				"connect":    s["connect"],
+				"tls":        s["tls"],
+				"ttfb":       s["ttfb"],
+				"total":      s["total"],
+				"errors":     s["errors"],
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
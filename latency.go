@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 未配置延迟监测目标时使用的默认目标
+var defaultLatencyTargets = []string{
+	"icmp://223.5.5.5",
+	"tcp://www.baidu.com:443",
+}
+
+// 延迟监测目标，支持以下格式：
+//
+//	tcp://host:port  测量TCP连接建立时间
+//	icmp://host      使用非特权ICMP套接字发送ping（仅Linux，需要net.ipv4.ping_group_range包含当前用户组）
+type latencyTarget struct {
+	raw    string
+	scheme string
+	host   string
+	port   string // tcp目标的端口
+}
+
+// 解析延迟监测目标
+func parseLatencyTarget(raw string) (latencyTarget, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return latencyTarget{}, fmt.Errorf("无效的延迟监测目标%s: %v", raw, err)
+	}
+
+	target := latencyTarget{raw: raw, scheme: u.Scheme, host: u.Hostname(), port: u.Port()}
+	if target.host == "" {
+		return target, fmt.Errorf("延迟监测目标%s缺少主机名", raw)
+	}
+	switch u.Scheme {
+	case "tcp":
+		if target.port == "" {
+			return target, fmt.Errorf("TCP延迟监测目标%s缺少端口", raw)
+		}
+	case "icmp":
+	default:
+		return target, fmt.Errorf("不支持的延迟监测目标%s，仅支持tcp和icmp", raw)
+	}
+	return target, nil
+}
+
+// 测量一次往返时间，ip为预先解析好的地址，避免域名解析计入延迟
+func (t latencyTarget) rtt(ctx context.Context, ip net.IP) (time.Duration, error) {
+	switch t.scheme {
+	case "tcp":
+		// 经过代理时测量的是通过代理建立隧道的耗时
+		start := time.Now()
+		conn, err := dialOutboundTCP(ctx, net.JoinHostPort(ip.String(), t.port))
+		if err != nil {
+			return 0, err
+		}
+		elapsed := time.Since(start)
+		conn.Close()
+		return elapsed, nil
+	case "icmp":
+		return pingICMP(ctx, ip)
+	}
+	return 0, fmt.Errorf("不支持的延迟监测目标: %s", t.raw)
+}
+
+// 一个目标在一个监测周期内的统计结果
+type latencyStats struct {
+	Sent     int
+	Received int
+	Min      time.Duration
+	Median   time.Duration
+	Max      time.Duration
+	Loss     float64 // 丢包率（百分比）
+	Err      error   // 全部失败时的最后一个错误
+}
+
+// 延迟监测：每个周期向每个目标依次发送若干次探测，保存最小/中位/最大延迟和丢包率
+type latencyMonitor struct {
+	targets  []latencyTarget
+	interval time.Duration
+	count    int
+	timeout  time.Duration
+}
+
+// 根据配置启动延迟监测，ctx结束时停止
+func startLatencyMonitor(ctx context.Context, cfg LatencyConfig) error {
+	rawTargets := cfg.Targets
+	if len(rawTargets) == 0 {
+		rawTargets = defaultLatencyTargets
+	}
+
+	m := &latencyMonitor{
+		interval: time.Duration(cfg.Interval) * time.Second,
+		count:    cfg.Count,
+		timeout:  time.Duration(cfg.Timeout) * time.Second,
+	}
+	if m.interval <= 0 {
+		m.interval = time.Minute
+	}
+	if m.count <= 0 {
+		m.count = 10
+	}
+	if m.timeout <= 0 {
+		m.timeout = 2 * time.Second
+	}
+	for _, raw := range rawTargets {
+		target, err := parseLatencyTarget(raw)
+		if err != nil {
+			return err
+		}
+		if target.scheme == "icmp" && config.Proxy != "" {
+			log.Printf("延迟监测目标%s使用ICMP，无法经过代理，将直接连接", raw)
+		}
+		m.targets = append(m.targets, target)
+	}
+
+	log.Printf("已启动延迟监测，间隔%v，每次%d个探测，监测目标: %s", m.interval, m.count, strings.Join(rawTargets, ", "))
+	go m.run(ctx)
+	return nil
+}
+
+func (m *latencyMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.round(ctx)
+		}
+	}
+}
+
+// 并发测量所有目标并保存本周期的结果
+func (m *latencyMonitor) round(ctx context.Context) {
+	now := time.Now()
+	stats := make([]latencyStats, len(m.targets))
+	done := make(chan struct{})
+	for i, target := range m.targets {
+		go func(i int, target latencyTarget) {
+			stats[i] = m.measure(ctx, target)
+			done <- struct{}{}
+		}(i, target)
+	}
+	for range m.targets {
+		<-done
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	for i, target := range m.targets {
+		if stats[i].Err != nil {
+			log.Printf("延迟监测%s全部失败: %v", target.raw, stats[i].Err)
+		}
+		if err := saveLatencyStats(target.raw, now, stats[i]); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+}
+
+// 向一个目标依次发送count次探测，探测均匀分布在监测周期的前半段内
+func (m *latencyMonitor) measure(ctx context.Context, target latencyTarget) latencyStats {
+	stats := latencyStats{Sent: m.count}
+
+	// 每个周期只解析一次域名
+	lookupCtx, cancel := context.WithTimeout(ctx, m.timeout)
+	addrs, err := net.DefaultResolver.LookupIPAddr(lookupCtx, target.host)
+	cancel()
+	if err != nil {
+		stats.Loss = 100
+		stats.Err = fmt.Errorf("解析%s失败: %v", target.host, err)
+		return stats
+	}
+	ip := addrs[0].IP
+
+	spacing := m.interval / time.Duration(2*m.count)
+	var rtts []time.Duration
+	for i := 0; i < m.count; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return stats
+			case <-time.After(spacing):
+			}
+		}
+
+		probeCtx, cancel := context.WithTimeout(ctx, m.timeout)
+		rtt, err := target.rtt(probeCtx, ip)
+		cancel()
+		if err != nil {
+			stats.Err = err
+			continue
+		}
+		rtts = append(rtts, rtt)
+	}
+
+	stats.Received = len(rtts)
+	stats.Loss = float64(m.count-len(rtts)) / float64(m.count) * 100
+	if len(rtts) == 0 {
+		return stats
+	}
+	stats.Err = nil
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	stats.Min = rtts[0]
+	stats.Median = medianDuration(rtts)
+	stats.Max = rtts[len(rtts)-1]
+	return stats
+}
+
+// 保存一个目标一个周期的统计结果，全部丢失时延迟为NULL
+func saveLatencyStats(target string, testTime time.Time, stats latencyStats) error {
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var minMs, medianMs, maxMs, errorMessage interface{}
+	if stats.Received > 0 {
+		minMs = durationMs(stats.Min)
+		medianMs = durationMs(stats.Median)
+		maxMs = durationMs(stats.Max)
+	}
+	if stats.Err != nil {
+		errorMessage = stats.Err.Error()
+	}
+	_, err = db.Exec(`INSERT INTO latency_results (target, test_time, sent, received, latency_min, latency_median, latency_max, packet_loss, error_message)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		target, testTime.Unix(), stats.Sent, stats.Received, minMs, medianMs, maxMs, stats.Loss, errorMessage)
+	if err != nil {
+		return fmt.Errorf("插入延迟监测结果失败: %v", err)
+	}
+	return nil
+}
+
+// 获取最近hours小时（默认24小时）每个目标的延迟监测结果，按时间从旧到新排列
+func latencyResultsHandler(w http.ResponseWriter, r *http.Request) {
+	hours, err := strconv.Atoi(r.URL.Query().Get("hours"))
+	if err != nil || hours <= 0 {
+		hours = 24
+	}
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+
+	db, err := openDatabase()
+	if err != nil {
+		log.Printf("%v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+	SELECT target, test_time, latency_min, latency_median, latency_max, packet_loss
+	FROM latency_results WHERE test_time >= ? ORDER BY target, test_time`, since.Unix())
+	if err != nil {
+		log.Printf("查询延迟监测结果失败: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// 按目标分组，查询结果已按目标名称排序
+	var targets []string
+	series := map[string]map[string][]interface{}{}
+	for rows.Next() {
+		var target string
+		var testTime int64
+		var latencyMin, latencyMedian, latencyMax sql.NullFloat64
+		var packetLoss float64
+		if err := rows.Scan(&target, &testTime, &latencyMin, &latencyMedian, &latencyMax, &packetLoss); err != nil {
+			log.Printf("扫描数据失败: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		s, ok := series[target]
+		if !ok {
+			targets = append(targets, target)
+			s = map[string][]interface{}{}
+			series[target] = s
+		}
+		s["timestamps"] = append(s["timestamps"], formatAPITime(testTime))
+		s["min"] = append(s["min"], nullFloat(latencyMin))
+		s["median"] = append(s["median"], nullFloat(latencyMedian))
+		s["max"] = append(s["max"], nullFloat(latencyMax))
+		s["loss"] = append(s["loss"], packetLoss)
+	}
+
+	result := []map[string]interface{}{}
+	for _, target := range targets {
+		s := series[target]
+		result = append(result, map[string]interface{}{
+			"target":     target,
+			"timestamps": s["timestamps"],
+			"min":        s["min"],
+			"median":     s["median"],
+			"max":        s["max"],
+			"loss":       s["loss"],
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// 使用非特权ICMP套接字(SOCK_DGRAM)发送一次ping并返回往返时间
+// 内核负责填写标识符和校验和，并只把属于本套接字的回复交给我们
+func pingICMP(ctx context.Context, ip net.IP) (time.Duration, error) {
+	family, proto, echoRequest, echoReply := syscall.AF_INET, syscall.IPPROTO_ICMP, byte(8), byte(0)
+	if ip.To4() == nil {
+		family, proto, echoRequest, echoReply = syscall.AF_INET6, syscall.IPPROTO_ICMPV6, 128, 129
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return 0, fmt.Errorf("创建ICMP套接字失败(请检查net.ipv4.ping_group_range): %v", err)
+	}
+	file := os.NewFile(uintptr(fd), "icmp")
+	conn, err := net.FilePacketConn(file)
+	file.Close()
+	if err != nil {
+		return 0, fmt.Errorf("创建ICMP套接字失败: %v", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	// 回显请求：类型、代码、校验和、标识符、序号，数据部分放入发送时间用于校验回复
+	seq := uint16(time.Now().UnixNano())
+	msg := make([]byte, 16)
+	msg[0] = echoRequest
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	binary.BigEndian.PutUint64(msg[8:], uint64(time.Now().UnixNano()))
+
+	start := time.Now()
+	if _, err := conn.WriteTo(msg, &net.UDPAddr{IP: ip}); err != nil {
+		return 0, fmt.Errorf("发送ICMP请求失败: %v", err)
+	}
+
+	reply := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(reply)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, fmt.Errorf("ICMP请求超时: %v", ctx.Err())
+			}
+			return 0, fmt.Errorf("接收ICMP回复失败: %v", err)
+		}
+		if n >= 8 && reply[0] == echoReply && binary.BigEndian.Uint16(reply[6:]) == seq {
+			return time.Since(start), nil
+		}
+	}
+}
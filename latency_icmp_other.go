@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// 非特权ICMP套接字仅在Linux上可用，其他系统请使用tcp://目标
+func pingICMP(ctx context.Context, ip net.IP) (time.Duration, error) {
+	return 0, fmt.Errorf("当前系统不支持icmp://延迟监测目标，请改用tcp://")
+}
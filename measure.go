@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// 测速阶段
+const (
+	PhaseSetup    = "setup" // 获取用户信息和服务器列表
+	PhasePing     = "ping"
+	PhaseDownload = "download"
+	PhaseUpload   = "upload"
+)
+
+// 测速模式，同时也是保存到speedtest_results.test_mode的值；各模式都会先测试延迟
+const (
+	ModeFull     = "full"     // 依次测试延迟、下载和上传（默认）
+	ModePing     = "ping"     // 只测试延迟
+	ModeDownload = "download" // 只测试延迟和下载速度
+	ModeUpload   = "upload"   // 只测试延迟和上传速度
+)
+
+// 校验测速模式，为空时返回完整测速
+func parseMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return ModeFull, nil
+	case ModeFull, ModePing, ModeDownload, ModeUpload:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("未知的测速模式: %s，仅支持full、ping、download和upload", mode)
+	}
+}
+
+// 该测速模式是否测试下载（PhaseDownload）或上传（PhaseUpload）速度，旧记录没有测速模式时视为完整测速
+func modeIncludes(mode, phase string) bool {
+	return mode == "" || mode == ModeFull || mode == phase
+}
+
+// 测速参数的简短描述，如"完整 15s×4"，用于区分不同参数的测速结果；旧记录没有参数时为"-"
+func formatTestParams(mode string, duration float64, connections int64) string {
+	names := map[string]string{ModeFull: "完整", ModePing: "仅延迟", ModeDownload: "仅下载", ModeUpload: "仅上传"}
+	name, ok := names[mode]
+	if !ok {
+		return "-"
+	}
+	if mode == ModePing {
+		return name
+	}
+	return fmt.Sprintf("%s %gs×%d", name, duration, connections)
+}
+
+// 测速结果状态
+const (
+	StatusOK       = "ok"
+	StatusTimeout  = "timeout"  // 某个阶段超时
+	StatusCanceled = "canceled" // 被用户取消
+	StatusFailed   = "failed"   // 其他错误，如无法获取服务器列表
+)
+
+// 测速参数
+type MeasureOptions struct {
+	Backend   string // 测速后端，为空时使用speedtest.net
+	ServerURL string // 自定义测速服务器地址，优先于ServerIDs（仅speedtest后端）
+	Family    string // 地址族：v4、v6、both（依次测试IPv4和IPv6），为空时由系统决定
+	Source    string // 出口网卡名称或源IP地址，为空时由系统路由决定
+	Interface string // 保存到结果中的出口名称，用于比较多个出口
+	Proxy     string // HTTP或SOCKS5代理地址（仅speedtest后端），为空时按环境变量决定
+
+	// 测速模式（见Mode*常量，为空时完整测速）、下载和上传各自的测试时长及并发连接数，
+	// 时长和连接数为0时使用后端的默认值
+	Mode        string
+	Duration    time.Duration
+	Connections int
+
+	// 以下仅speedtest后端使用：指定了ServerIDs时依次测试这些服务器，
+	// 否则测试距离最近的ServerCount个服务器，ServerCount不大于1时自动选择一个服务器
+	ServerIDs   []string
+	ServerCount int
+
+	LoadedLatency bool // 在下载和上传期间持续采样延迟，用于评估缓冲膨胀
+
+	Timeouts Timeouts // 各阶段的超时时间
+
+	Traceroute TracerouteConfig // 测速结果异常时traceroute到测速服务器
+}
+
+// 一次测速的结构化结果
+type MeasureResult struct {
+	ID             int64  // 保存到数据库后的记录ID
+	RunID          string // 同一轮测速（可能包含多个服务器）共用的ID
+	Key            string // 测速结果的唯一标识"轮次ID/序号"，吞吐量采样和traceroute按其关联，不依赖存储分配的记录ID
+	Status         string // 测速状态，见Status*常量
+	FailedPhase    string // 失败的阶段，见Phase*常量
+	Err            error  // 测速失败的原因，成功时为nil
+	Backend        string
+	ISP            string
+	ServerName     string
+	ServerCountry  string
+	ServerDistance float64
+	ServerHost     string        // 测速服务器地址(host:port)，用于traceroute
+	ServerID       string        // speedtest.net的服务器ID，自定义服务器为Custom，iperf3后端为空
+	ServerSponsor  string        // 服务器的运营方
+	ServerLat      string        // 服务器纬度，未知时为空或"?"，无法解析时保存为NULL
+	ServerLon      string        // 服务器经度
+	PublicIP       string        // 测速时本机的公网IP（由speedtest.net返回），无法得知时为空
+	Family         string        // 实际使用的地址族（v4或v6），无法得知时为空
+	Interface      string        // 测速使用的出口名称，未指定出口时为空
+	Latency        time.Duration // 平均延迟
+	Jitter         time.Duration // 抖动：相邻两次延迟差值的平均值
+	LatencyMin     time.Duration
+	LatencyMax     time.Duration
+	LatencyMedian  time.Duration
+	PacketLoss     float64 // 丢包率(%)，-1表示后端不支持
+
+	// 负载延迟（仅在启用LoadedLatency时测量），为下载/上传期间延迟采样的中位数
+	LatencyDownload  time.Duration
+	LatencyUpload    time.Duration
+	BufferbloatGrade string // 缓冲膨胀等级A–F，未测量时为空
+
+	DownloadMbps float64 // 测速模式不包括下载时为0，保存为NULL
+	UploadMbps   float64 // 测速模式不包括上传时为0，保存为NULL
+	TestTime     time.Time
+
+	// 实际使用的测速参数，参数不同的结果不应直接比较
+	Mode        string
+	Duration    time.Duration
+	Connections int
+
+	// 执行测速的程序版本和后端的版本（如 speedtest-go 1.7.10、iperf 3.9），用于排查版本升级前后结果的差异
+	ClientVersion  string
+	BackendVersion string
+
+	Bytes int64 // 测速收发的数据量（字节），包括获取服务器列表等请求，失败的测速为失败前已传输的数据量
+
+	Samples []ThroughputSample // 下载和上传过程中每秒的吞吐量
+}
+
+// 使用指定的后端执行一轮完整测速，每个服务器返回一条结果，地址族为both时IPv4和IPv6各返回一组结果
+// 开始测速前就失败时（如无法获取服务器列表），返回一条记录失败原因的结果和对应的错误
+func runMeasurement(ctx context.Context, opts MeasureOptions) ([]*MeasureResult, error) {
+	backend, err := newBackend(opts.Backend)
+	if err != nil {
+		return nil, err
+	}
+	families, err := measureFamilies(opts.Family)
+	if err != nil {
+		return nil, err
+	}
+	opts.Mode, err = parseMode(opts.Mode)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Duration < 0 || opts.Connections < 0 {
+		return nil, fmt.Errorf("测试时长和并发连接数不能为负数")
+	}
+
+	// 未指定的参数使用后端的默认值，保存到结果中的是实际使用的参数
+	duration, connections := backend.Defaults()
+	if opts.Duration == 0 {
+		opts.Duration = duration
+	}
+	if opts.Connections == 0 {
+		opts.Connections = connections
+	}
+	// 测试时长较长时相应延长未配置的下载和上传超时时间
+	minTimeout := int((opts.Duration + 30*time.Second) / time.Second)
+	if opts.Timeouts.Download <= 0 && minTimeout > 60 {
+		opts.Timeouts.Download = minTimeout
+	}
+	if opts.Timeouts.Upload <= 0 && minTimeout > 60 {
+		opts.Timeouts.Upload = minTimeout
+	}
+
+	var all []*MeasureResult
+	var firstErr error
+	started := false
+	for _, family := range families {
+		familyOpts := opts
+		familyOpts.Family = family
+		results, err := backend.Measure(ctx, familyOpts)
+		if err != nil {
+			if len(families) > 1 {
+				err = fmt.Errorf("%s测速失败: %w", familyName(family), err)
+			}
+			results = []*MeasureResult{{Err: err, Family: family, PacketLoss: -1, TestTime: time.Now()}}
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			started = true
+		}
+		for _, result := range results {
+			result.Backend = backend.Name()
+			result.Status = statusForError(result.Err)
+			result.FailedPhase = failedPhase(result.Err)
+			result.Interface = opts.Interface
+			result.Mode = opts.Mode
+			result.Duration = opts.Duration
+			result.Connections = opts.Connections
+			result.ClientVersion = programVersion()
+			// 指定了地址族时以其为准，否则使用后端检测到的地址族
+			if family != FamilyAuto {
+				result.Family = family
+			}
+		}
+		all = append(all, results...)
+		if ctx.Err() != nil || abandonedResult(results) {
+			break
+		}
+	}
+	// 只要有一个地址族开始了测速，就不视为整轮失败
+	if started {
+		return all, nil
+	}
+	return all, firstErr
+}
+
+// 结果中是否有阶段取消后仍未结束，此时不再测试其余地址族
+func abandonedResult(results []*MeasureResult) bool {
+	for _, result := range results {
+		if phaseAbandoned(result.Err) {
+			return true
+		}
+	}
+	return false
+}
+
+// 阶段超时或被取消后等待其结束的最长时间。speedtest-go的下载/上传测试取消后不再传输数据，
+// 但要到采样时间结束才返回，超过该时间仍未结束时放弃等待
+var phaseGracePeriod = 5 * time.Second
+
+// 测速某个阶段失败的错误，用于记录失败的阶段
+type phaseError struct {
+	phase     string
+	err       error
+	abandoned bool // 取消后在phaseGracePeriod内仍未结束，后台可能仍在传输数据
+}
+
+func (e *phaseError) Error() string {
+	return e.err.Error()
+}
+
+func (e *phaseError) Unwrap() error {
+	return e.err
+}
+
+// 为错误标记失败的阶段，err为nil时返回nil
+func newPhaseError(phase string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &phaseError{phase: phase, err: err}
+}
+
+// 错误中标记的阶段是否在取消后仍未结束。此后的阶段和流量统计会混入其仍在进行的传输，
+// 不应继续测速
+func phaseAbandoned(err error) bool {
+	var pe *phaseError
+	return errors.As(err, &pe) && pe.abandoned
+}
+
+// 返回错误中标记的失败阶段，未标记时返回空字符串
+func failedPhase(err error) string {
+	var pe *phaseError
+	if errors.As(err, &pe) {
+		return pe.phase
+	}
+	return ""
+}
+
+// 在单独的超时上下文中执行一个测速阶段，返回的错误标记了该阶段。超时或被取消时最多再等待
+// phaseGracePeriod让fn结束，避免其传输计入之后的阶段；仍未结束时在错误中标记，见phaseAbandoned
+func runPhase(ctx context.Context, phase string, timeouts Timeouts, fn func(ctx context.Context) error) error {
+	timeout := timeouts.phase(phase)
+	phaseCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(phaseCtx)
+	}()
+
+	var err error
+	finished := true
+	select {
+	case err = <-done:
+	case <-phaseCtx.Done():
+		finished = false
+	}
+	if phaseCtx.Err() == nil {
+		return newPhaseError(phase, err)
+	}
+
+	if ctx.Err() == nil {
+		err = fmt.Errorf("超过%v未完成: %w", timeout, phaseCtx.Err())
+	} else {
+		err = fmt.Errorf("测速已取消: %w", ctx.Err())
+	}
+	if !finished {
+		select {
+		case <-done:
+		case <-time.After(phaseGracePeriod):
+			log.Printf("%s阶段取消后%v内仍未结束，不再继续测速", phase, phaseGracePeriod)
+			return &phaseError{phase: phase, err: fmt.Errorf("%w，且取消后%v内仍未结束", err, phaseGracePeriod), abandoned: true}
+		}
+	}
+	return newPhaseError(phase, err)
+}
+
+// 根据错误判断测速状态
+func statusForError(err error) string {
+	switch {
+	case err == nil:
+		return StatusOK
+	case errors.Is(err, context.Canceled):
+		return StatusCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return StatusTimeout
+	default:
+		return StatusFailed
+	}
+}
+
+// 根据每次延迟采样计算延迟统计，samples为空时所有字段为0
+func (r *MeasureResult) setLatencySamples(samples []time.Duration) {
+	if len(samples) == 0 {
+		return
+	}
+
+	var sum, diffSum time.Duration
+	r.LatencyMin, r.LatencyMax = samples[0], samples[0]
+	for i, v := range samples {
+		sum += v
+		if v < r.LatencyMin {
+			r.LatencyMin = v
+		}
+		if v > r.LatencyMax {
+			r.LatencyMax = v
+		}
+		if i > 0 {
+			diff := v - samples[i-1]
+			if diff < 0 {
+				diff = -diff
+			}
+			diffSum += diff
+		}
+	}
+
+	r.Latency = sum / time.Duration(len(samples))
+	if len(samples) > 1 {
+		r.Jitter = diffSum / time.Duration(len(samples)-1)
+	}
+	r.LatencyMedian = medianDuration(samples)
+}
+
+// 将时长转换为毫秒（保留小数）
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// 时长为0（未测量）时保存为NULL
+func nullableMs(d time.Duration) sql.NullFloat64 {
+	return sql.NullFloat64{Float64: durationMs(d), Valid: d > 0}
+}
+
+// 字符串为空时保存为NULL
+func nullableString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// 保存测试结果：测速结果写入配置的存储，吞吐量采样与测速结果一起写入SQLite数据库，
+// 测速结果保存在其他存储中时不保存吞吐量采样
+func saveResult(result *MeasureResult) error {
+	id, err := store.Insert(newResultRecord(result))
+	if err != nil {
+		return err
+	}
+	result.ID = id
+	if len(result.Samples) == 0 || !storeIsSQLite() {
+		return nil
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer tx.Rollback()
+	if err := saveThroughputSamples(tx, result, result.Samples); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("提交事务失败: %v", err)
+	}
+	return nil
+}
+
+// 正在进行的测速，用于从Web界面取消
+var runningTests = struct {
+	sync.Mutex
+	next    int
+	cancels map[int]context.CancelFunc
+}{cancels: map[int]context.CancelFunc{}}
+
+// 登记一次正在进行的测速，返回的函数用于在测速结束后注销
+func trackTest(cancel context.CancelFunc) func() {
+	runningTests.Lock()
+	id := runningTests.next
+	runningTests.next++
+	runningTests.cancels[id] = cancel
+	runningTests.Unlock()
+
+	return func() {
+		runningTests.Lock()
+		delete(runningTests.cancels, id)
+		runningTests.Unlock()
+	}
+}
+
+// 取消所有正在进行的测速，返回取消的数量
+func cancelRunningTests() int {
+	runningTests.Lock()
+	defer runningTests.Unlock()
+	for _, cancel := range runningTests.cancels {
+		cancel()
+	}
+	return len(runningTests.cancels)
+}
+
+// 执行一轮测速并保存结果，CLI、自动测速和Web接口共用此入口
+// 失败的测速同样保存，没有任何服务器测速成功时返回的错误不为nil
+func runTest(ctx context.Context, opts MeasureOptions) (*RunResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer trackTest(cancel)()
+
+	results, err := runMeasurement(ctx, opts)
+	if len(results) == 0 {
+		return nil, err
+	}
+
+	run := newRunResult(newRunID(), results)
+	for i, result := range results {
+		result.RunID = run.ID
+		result.Key = fmt.Sprintf("%s/%d", run.ID, i+1)
+		if err := saveResult(result); err != nil {
+			return run, err
+		}
+		// 经过代理时到测速服务器的路径与本机无关，不traceroute
+		if opts.Traceroute.Enabled && opts.Proxy == "" {
+			traceDegradedResult(ctx, result, opts.Source, opts.Traceroute)
+		}
+	}
+	if err != nil {
+		return run, err
+	}
+	return run, run.err()
+}
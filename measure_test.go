@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRunPhase(t *testing.T) {
+	previous := phaseGracePeriod
+	phaseGracePeriod = 100 * time.Millisecond
+	defer func() { phaseGracePeriod = previous }()
+
+	tests := []struct {
+		name          string
+		fn            func(ctx context.Context) error
+		wantErr       error
+		wantAbandoned bool
+	}{
+		{"完成", func(ctx context.Context) error { return nil }, nil, false},
+		{"失败", func(ctx context.Context) error { return errors.New("failed") }, nil, false},
+		{"取消后结束", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}, context.Canceled, false},
+		{"取消后稍晚结束", func(ctx context.Context) error {
+			<-ctx.Done()
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		}, context.Canceled, false},
+		{"取消后仍未结束", func(ctx context.Context) error {
+			time.Sleep(time.Second)
+			return nil
+		}, context.Canceled, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.wantErr != nil {
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+			defer cancel()
+
+			err := runPhase(ctx, PhaseDownload, Timeouts{}, tt.fn)
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && failedPhase(err) != PhaseDownload {
+				t.Errorf("失败阶段 = %q", failedPhase(err))
+			}
+			if got := phaseAbandoned(err); got != tt.wantAbandoned {
+				t.Errorf("phaseAbandoned = %v, want %v (err: %v)", got, tt.wantAbandoned, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// *sql.DB和*sql.Tx共有的方法，迁移在事务中执行，建表函数两者都可以使用
+type dbExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// 数据库迁移，按版本号顺序执行，执行过的版本记录在schema_version表中
+//
+// 迁移必须是幂等的：引入schema_version之前的数据库版本未知，会从版本1开始执行所有迁移。
+// 新增列使用ensureColumn，新增表和索引使用IF NOT EXISTS；已发布的迁移不能修改，只能追加新的迁移。
+// 表结构只由迁移定义，migrate_test.go中记录了执行所有迁移后的表结构，追加迁移时同步更新
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// 所有迁移，版本号从1开始连续递增
+var migrations = []migration{
+	{1, "初始表结构", initialSchema},
+	{2, "将测速时间列统一为TEXT类型", textTestTime},
+	{3, "为测速结果的时间、轮次和出口建立索引", func(tx *sql.Tx) error {
+		indexes := []string{
+			"CREATE INDEX IF NOT EXISTS idx_speedtest_results_time ON speedtest_results (test_time)",
+			"CREATE INDEX IF NOT EXISTS idx_speedtest_results_run ON speedtest_results (run_id)",
+			"CREATE INDEX IF NOT EXISTS idx_speedtest_results_interface ON speedtest_results (interface, test_time)",
+		}
+		for _, stmt := range indexes {
+			if _, err := tx.Exec(stmt); err != nil {
+				return fmt.Errorf("创建索引失败: %v", err)
+			}
+		}
+		return nil
+	}},
+	{4, "测速结果增加服务器ID、地址、运营方、经纬度、公网IP和版本", func(tx *sql.Tx) error {
+		columns := []struct {
+			name       string
+			definition string
+		}{
+			{"server_id", "TEXT"},       // speedtest.net的服务器ID
+			{"server_host", "TEXT"},     // 服务器地址(host:port)
+			{"server_sponsor", "TEXT"},  // 服务器的运营方
+			{"server_lat", "REAL"},      // 服务器纬度
+			{"server_lon", "REAL"},      // 服务器经度
+			{"public_ip", "TEXT"},       // 测速时本机的公网IP
+			{"client_version", "TEXT"},  // 程序版本
+			{"backend_version", "TEXT"}, // 测速后端的版本
+		}
+		for _, c := range columns {
+			if err := ensureColumn(tx, "speedtest_results", c.name, c.definition); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{5, "将时间统一保存为UTC Unix时间戳", unixTimestamps},
+	{6, "测速结果增加唯一标识，吞吐量采样和traceroute按唯一标识关联", resultKeys},
+	{7, "将迁移记录的执行时间保存为UTC Unix时间戳", func(tx *sql.Tx) error {
+		// 之前按系统时区写入本地时间字符串，与迁移5转换的其他时间列相同
+		if err := rebuildTable(tx, "schema_version", map[string]string{"applied_at": "INTEGER"}); err != nil {
+			return err
+		}
+		return convertLocalTimes(tx, "schema_version", "applied_at")
+	}},
+}
+
+// 引入版本化迁移之前的表结构：早期版本只有speedtest_results表的前几列，其余列和表由后续版本陆续添加
+func initialSchema(tx *sql.Tx) error {
+	// 创建表，早期版本以TIMESTAMP类型创建的test_time列由迁移2修正
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS speedtest_results (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		isp TEXT,
+		server_name TEXT,
+		server_country TEXT,
+		server_distance REAL,
+		latency INTEGER,
+		download_speed REAL,
+		upload_speed REAL,
+		test_time TEXT
+	)
+	`
+	if _, err := tx.Exec(createTableSQL); err != nil {
+		return fmt.Errorf("创建表失败: %v", err)
+	}
+
+	// 引入版本化迁移之前陆续新增的列，旧版本创建的数据库会自动补齐
+	columns := []struct {
+		name       string
+		definition string
+	}{
+		{"backend", "TEXT DEFAULT 'speedtest'"},
+		{"jitter", "REAL"},              // 抖动(ms)
+		{"latency_min", "REAL"},         // 最小延迟(ms)
+		{"latency_max", "REAL"},         // 最大延迟(ms)
+		{"latency_median", "REAL"},      // 延迟中位数(ms)
+		{"packet_loss", "REAL"},         // 丢包率(%)，后端不支持时为NULL
+		{"latency_download", "REAL"},    // 下载负载延迟(ms)
+		{"latency_upload", "REAL"},      // 上传负载延迟(ms)
+		{"bufferbloat_grade", "TEXT"},   // 缓冲膨胀等级A–F
+		{"run_id", "TEXT"},              // 测速轮次ID，同一轮测试的多个服务器共用
+		{"status", "TEXT DEFAULT 'ok'"}, // 测速状态：ok、timeout、canceled、failed
+		{"failed_phase", "TEXT"},        // 失败的阶段：setup、ping、download、upload
+		{"error_message", "TEXT"},       // 失败原因
+		{"ip_family", "TEXT"},           // 地址族：v4、v6，无法得知时为NULL
+		{"interface", "TEXT"},           // 出口名称，未指定出口时为NULL
+		{"test_mode", "TEXT"},           // 测速模式：full、ping、download、upload，旧记录为NULL
+		{"test_duration", "REAL"},       // 下载和上传各自的测试时长(秒)
+		{"connections", "INTEGER"},      // 并发连接数
+		{"bytes_used", "INTEGER"},       // 测速收发的数据量(字节)，旧记录为NULL
+	}
+	for _, c := range columns {
+		if err := ensureColumn(tx, "speedtest_results", c.name, c.definition); err != nil {
+			return err
+		}
+	}
+
+	for _, stmt := range initialTables {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("创建表失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// 引入版本化迁移时其他表的结构。迁移1已经发布，这里的定义不能修改，之后的变化由后续迁移完成
+var initialTables = []string{
+	// 每次测速的吞吐量曲线
+	`CREATE TABLE IF NOT EXISTS speedtest_samples (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		result_id INTEGER NOT NULL,
+		phase TEXT,
+		seconds REAL,
+		speed REAL
+	)`,
+	"CREATE INDEX IF NOT EXISTS idx_speedtest_samples_result ON speedtest_samples (result_id)",
+
+	// 浏览器测速结果单独存放
+	`CREATE TABLE IF NOT EXISTS browser_results (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		visitor_ip TEXT,
+		user_agent TEXT,
+		latency REAL,
+		jitter REAL,
+		download_speed REAL,
+		upload_speed REAL,
+		test_time TEXT
+	)`,
+
+	// 断网监测记录
+	`CREATE TABLE IF NOT EXISTS outages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		start_time TEXT NOT NULL,
+		end_time TEXT,
+		last_failure TEXT,
+		duration REAL,
+		error_message TEXT
+	)`,
+
+	// 延迟监测结果
+	`CREATE TABLE IF NOT EXISTS latency_results (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		target TEXT NOT NULL,
+		test_time TEXT NOT NULL,
+		sent INTEGER NOT NULL,
+		received INTEGER NOT NULL,
+		latency_min REAL,
+		latency_median REAL,
+		latency_max REAL,
+		packet_loss REAL NOT NULL,
+		error_message TEXT
+	)`,
+	"CREATE INDEX IF NOT EXISTS idx_latency_results_target_time ON latency_results (target, test_time)",
+
+	// DNS解析测试结果
+	`CREATE TABLE IF NOT EXISTS dns_results (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		run_id TEXT NOT NULL,
+		resolver TEXT NOT NULL,
+		domain TEXT NOT NULL,
+		duration REAL,
+		error_message TEXT,
+		test_time TEXT NOT NULL
+	)`,
+
+	// 网页加载耗时探测结果
+	`CREATE TABLE IF NOT EXISTS http_probe_results (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		url TEXT NOT NULL,
+		status_code INTEGER,
+		dns_time REAL NOT NULL,
+		connect_time REAL NOT NULL,
+		tls_time REAL NOT NULL,
+		ttfb REAL,
+		total_time REAL,
+		bytes INTEGER NOT NULL,
+		error_message TEXT,
+		test_time TEXT NOT NULL
+	)`,
+
+	// 测速结果异常时的traceroute记录
+	`CREATE TABLE IF NOT EXISTS traceroutes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		result_id INTEGER NOT NULL,
+		target TEXT NOT NULL,
+		protocol TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		reached INTEGER NOT NULL,
+		error_message TEXT,
+		test_time TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS traceroute_hops (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		traceroute_id INTEGER NOT NULL,
+		ttl INTEGER NOT NULL,
+		address TEXT,
+		rtt REAL
+	)`,
+}
+
+// 早期版本在main中以TIMESTAMP类型创建test_time列，go-sqlite3读取该类型的列时会解析为时间，
+// 输出格式与TEXT列不同。SQLite不能修改列的类型，因此重建speedtest_results表，其余列保持不变
+func textTestTime(tx *sql.Tx) error {
+	return rebuildTable(tx, "speedtest_results", map[string]string{"test_time": "TEXT"})
+}
+
+// 保存时间的列，迁移5之前保存为本地时间字符串
+var timeColumns = []struct {
+	table   string
+	columns []string
+}{
+	{"speedtest_results", []string{"test_time"}},
+	{"browser_results", []string{"test_time"}},
+	{"dns_results", []string{"test_time"}},
+	{"http_probe_results", []string{"test_time"}},
+	{"latency_results", []string{"test_time"}},
+	{"outages", []string{"start_time", "end_time", "last_failure"}},
+	{"traceroutes", []string{"test_time"}},
+}
+
+// 将所有时间列改为INTEGER类型的UTC Unix时间戳。旧记录是按运行程序的系统时区写入的本地时间，
+// 本身不带时区，转换时按legacyLocation（-legacy-tz，默认为当前的系统时区）解释
+func unixTimestamps(tx *sql.Tx) error {
+	for _, t := range timeColumns {
+		types := map[string]string{}
+		for _, column := range t.columns {
+			types[column] = "INTEGER"
+		}
+		if err := rebuildTable(tx, t.table, types); err != nil {
+			return err
+		}
+		for _, column := range t.columns {
+			if err := convertLocalTimes(tx, t.table, column); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 将列中"2006-01-02 15:04:05"格式的本地时间字符串转换为Unix时间戳，已经是整数的值不变。
+// 按rowid定位记录，主键为id或version（INTEGER PRIMARY KEY即rowid）的表都适用
+func convertLocalTimes(tx *sql.Tx, table, column string) error {
+	rows, err := tx.Query(fmt.Sprintf("SELECT rowid, %s FROM %s WHERE typeof(%s) = 'text'", column, table, column))
+	if err != nil {
+		return fmt.Errorf("查询%s.%s失败: %v", table, column, err)
+	}
+	defer rows.Close()
+
+	converted := map[int64]int64{}
+	for rows.Next() {
+		var id int64
+		var value string
+		if err := rows.Scan(&id, &value); err != nil {
+			return fmt.Errorf("扫描%s.%s失败: %v", table, column, err)
+		}
+		t, err := parseLegacyTime(value, legacyLocation)
+		if err != nil {
+			return fmt.Errorf("无法解析%s中记录%d的%s: %s", table, id, column, value)
+		}
+		converted[id] = t.Unix()
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("遍历%s.%s失败: %v", table, column, err)
+	}
+	rows.Close()
+
+	for id, ts := range converted {
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE rowid = ?", table, column), ts, id); err != nil {
+			return fmt.Errorf("更新%s.%s失败: %v", table, column, err)
+		}
+	}
+	if len(converted) > 0 {
+		log.Printf("已按时区%s将%s.%s中的%d个本地时间转换为时间戳", describeLocation(legacyLocation), table, column, len(converted))
+	}
+	return nil
+}
+
+// 测速结果可以保存在其他存储中，存储分配的记录ID与SQLite中的吞吐量采样和traceroute无关，可能重复，
+// 因此改为按测速结果的唯一标识result_key关联。已有的记录在同一个数据库中，按记录ID生成标识
+func resultKeys(tx *sql.Tx) error {
+	if err := ensureColumn(tx, "speedtest_results", "result_key", "TEXT"); err != nil {
+		return err
+	}
+	statements := []string{
+		"UPDATE speedtest_results SET result_key = COALESCE(run_id, 'r' || id) || '/' || id WHERE result_key IS NULL",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_speedtest_results_key ON speedtest_results (result_key)",
+	}
+	for _, table := range []string{"speedtest_samples", "traceroutes"} {
+		if err := ensureColumn(tx, table, "result_key", "TEXT"); err != nil {
+			return err
+		}
+		statements = append(statements,
+			fmt.Sprintf("UPDATE %s SET result_key = (SELECT result_key FROM speedtest_results WHERE speedtest_results.id = %s.result_id) WHERE result_key IS NULL", table, table),
+			fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_key ON %s (result_key)", table, table),
+		)
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("生成测速结果的唯一标识失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// 修改表中部分列的声明类型。SQLite不能修改列的类型，因此按原有的列（保留默认值和NOT NULL）和新的类型
+// 创建新表并复制数据，再重建原有的索引；所有列已经是目标类型时不做任何修改
+func rebuildTable(tx *sql.Tx, table string, types map[string]string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("查询表结构失败: %v", err)
+	}
+	defer rows.Close()
+
+	var names, definitions []string
+	rebuild, autoIncrement := false, false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("扫描表结构失败: %v", err)
+		}
+		if newType, ok := types[name]; ok {
+			rebuild = rebuild || colType != newType
+			colType = newType
+		}
+		definition := name + " " + colType
+		switch {
+		case name == "id":
+			definition = "id INTEGER PRIMARY KEY AUTOINCREMENT"
+			autoIncrement = true
+		case pk > 0:
+			// 只有单列主键，如schema_version.version
+			definition += " PRIMARY KEY"
+		default:
+			if notNull != 0 {
+				definition += " NOT NULL"
+			}
+			if defaultValue.Valid {
+				definition += " DEFAULT " + defaultValue.String
+			}
+		}
+		names = append(names, name)
+		definitions = append(definitions, definition)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("遍历表结构失败: %v", err)
+	}
+	rows.Close()
+	if !rebuild {
+		return nil
+	}
+
+	// 删除旧表时其索引会一并删除，先保存索引的定义
+	var indexes []string
+	rows, err = tx.Query("SELECT sql FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL", table)
+	if err != nil {
+		return fmt.Errorf("查询索引失败: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var index string
+		if err := rows.Scan(&index); err != nil {
+			return fmt.Errorf("扫描索引失败: %v", err)
+		}
+		indexes = append(indexes, index)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("遍历索引失败: %v", err)
+	}
+	rows.Close()
+
+	columns := strings.Join(names, ", ")
+	statements := []string{
+		fmt.Sprintf("CREATE TABLE %s_new (%s)", table, strings.Join(definitions, ", ")),
+		fmt.Sprintf("INSERT INTO %s_new (%s) SELECT %s FROM %s", table, columns, columns, table),
+	}
+	if autoIncrement {
+		// 删除旧表时其AUTOINCREMENT计数一并删除，新表只按复制的最大ID计数，会重新使用已删除的最后几条记录的ID，
+		// 因此沿用旧表的计数（旧表没有AUTOINCREMENT时为其最大ID）
+		statements = append(statements,
+			fmt.Sprintf("DELETE FROM sqlite_sequence WHERE name = '%s_new'", table),
+			fmt.Sprintf(`INSERT INTO sqlite_sequence (name, seq) SELECT '%s_new', MAX(
+				COALESCE((SELECT seq FROM sqlite_sequence WHERE name = '%s'), 0),
+				COALESCE((SELECT MAX(id) FROM %s), 0))`, table, table, table))
+	}
+	statements = append(statements,
+		fmt.Sprintf("DROP TABLE %s", table),
+		fmt.Sprintf("ALTER TABLE %s_new RENAME TO %s", table, table),
+	)
+	statements = append(statements, indexes...)
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("重建%s表失败: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// 最新的数据库版本
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// 创建schema_version表，每执行一个迁移记录一行
+func createSchemaVersionTable(db dbExecer) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		description TEXT,
+		applied_at INTEGER
+	)
+	`)
+	if err != nil {
+		return fmt.Errorf("创建版本表失败: %v", err)
+	}
+	return nil
+}
+
+// 返回数据库的当前版本，尚未执行过任何迁移（没有schema_version表）时为0。只查询，不修改数据库
+func schemaVersion(db dbExecer) (int, error) {
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'").Scan(&tables); err != nil {
+		return 0, fmt.Errorf("查询数据库版本失败: %v", err)
+	}
+	if tables == 0 {
+		return 0, nil
+	}
+	var version int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("查询数据库版本失败: %v", err)
+	}
+	return version, nil
+}
+
+// 返回尚未执行的迁移；数据库版本高于程序支持的版本时返回错误，避免旧版本程序写坏新的表结构
+func pendingMigrations(db dbExecer) ([]migration, error) {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if version > latestSchemaVersion() {
+		return nil, fmt.Errorf("数据库版本%d高于程序支持的版本%d，请升级程序", version, latestSchemaVersion())
+	}
+
+	var pending []migration
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// 依次执行尚未执行的迁移，每个迁移与其版本记录在同一事务中提交，applied在每个迁移完成后调用
+func migrateDatabase(db *sql.DB, applied func(m migration)) error {
+	pending, err := pendingMigrations(db)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	if err := createSchemaVersionTable(db); err != nil {
+		return err
+	}
+
+	for _, m := range pending {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("开始事务失败: %v", err)
+		}
+		if err := m.apply(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("执行迁移%d（%s）失败: %v", m.version, m.description, err)
+		}
+		_, err = tx.Exec("INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)",
+			m.version, m.description, time.Now().Unix())
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("记录数据库版本失败: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("提交事务失败: %v", err)
+		}
+		if applied != nil {
+			applied(m)
+		}
+	}
+	return nil
+}
+
+// -migrate：输出数据库的版本和迁移记录，并执行尚未执行的迁移
+func runMigrations() {
+	db, err := openDatabase()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer db.Close()
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	fmt.Printf("数据库: %s\n当前版本: %d, 最新版本: %d\n", DBPath, version, latestSchemaVersion())
+
+	// 尚未执行过迁移的数据库没有schema_version表
+	if version > 0 {
+		printAppliedMigrations(db)
+	}
+
+	pending, err := pendingMigrations(db)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if len(pending) == 0 {
+		fmt.Println("\n数据库已是最新版本")
+		return
+	}
+	fmt.Println("\n待执行的迁移:")
+	for _, m := range pending {
+		fmt.Printf("  %-4d %s\n", m.version, m.description)
+	}
+	fmt.Println()
+
+	err = migrateDatabase(db, func(m migration) {
+		fmt.Printf("已执行迁移%d: %s\n", m.version, m.description)
+	})
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	fmt.Printf("数据库已升级到版本%d\n", latestSchemaVersion())
+}
+
+// 输出schema_version中记录的已执行的迁移
+func printAppliedMigrations(db *sql.DB) {
+	rows, err := db.Query("SELECT version, description, applied_at FROM schema_version ORDER BY version")
+	if err != nil {
+		log.Fatalf("查询迁移记录失败: %v", err)
+	}
+	defer rows.Close()
+	header := false
+	for rows.Next() {
+		var v int
+		var description sql.NullString
+		var appliedAt interface{}
+		if err := rows.Scan(&v, &description, &appliedAt); err != nil {
+			log.Fatalf("扫描迁移记录失败: %v", err)
+		}
+		if !header {
+			fmt.Println("\n已执行的迁移:")
+			header = true
+		}
+		// 迁移7之前执行时间为本地时间字符串
+		appliedTime := fmt.Sprint(appliedAt)
+		if ts, ok := appliedAt.(int64); ok {
+			appliedTime = formatLocalTime(ts)
+		}
+		fmt.Printf("  %-4d %-20s %s\n", v, appliedTime, description.String)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("遍历迁移记录失败: %v", err)
+	}
+	rows.Close()
+}
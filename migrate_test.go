@@ -0,0 +1,428 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 使用临时目录中的数据库，测试结束后恢复DBPath
+func openTestDatabase(t *testing.T) *sql.DB {
+	t.Helper()
+	previous := DBPath
+	DBPath = filepath.Join(t.TempDir(), "results.db")
+	t.Cleanup(func() { DBPath = previous })
+
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// 表的列定义和索引，用于比较两个数据库的表结构
+func tableSchema(t *testing.T, db *sql.DB, table string) string {
+	t.Helper()
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var lines []string
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, fmt.Sprintf("%s %s notnull=%d default=%v pk=%d", name, colType, notNull, defaultValue.String, pk))
+	}
+	if len(lines) == 0 {
+		t.Fatalf("表%s不存在", table)
+	}
+
+	indexes, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL ORDER BY name", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexes.Close()
+	for indexes.Next() {
+		var name string
+		if err := indexes.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, "index "+name)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 从空数据库执行所有迁移后各表的结构。表结构只能通过追加迁移修改，修改后同步更新这里，
+// 从旧版本升级的数据库执行相同的迁移，因此也会得到相同的结构
+var migratedSchemas = []struct {
+	table  string
+	schema []string
+}{
+	{"speedtest_results", []string{
+		"id INTEGER notnull=0 default= pk=1",
+		"isp TEXT notnull=0 default= pk=0",
+		"server_name TEXT notnull=0 default= pk=0",
+		"server_country TEXT notnull=0 default= pk=0",
+		"server_distance REAL notnull=0 default= pk=0",
+		"latency INTEGER notnull=0 default= pk=0",
+		"download_speed REAL notnull=0 default= pk=0",
+		"upload_speed REAL notnull=0 default= pk=0",
+		"test_time INTEGER notnull=0 default= pk=0",
+		"backend TEXT notnull=0 default='speedtest' pk=0",
+		"jitter REAL notnull=0 default= pk=0",
+		"latency_min REAL notnull=0 default= pk=0",
+		"latency_max REAL notnull=0 default= pk=0",
+		"latency_median REAL notnull=0 default= pk=0",
+		"packet_loss REAL notnull=0 default= pk=0",
+		"latency_download REAL notnull=0 default= pk=0",
+		"latency_upload REAL notnull=0 default= pk=0",
+		"bufferbloat_grade TEXT notnull=0 default= pk=0",
+		"run_id TEXT notnull=0 default= pk=0",
+		"status TEXT notnull=0 default='ok' pk=0",
+		"failed_phase TEXT notnull=0 default= pk=0",
+		"error_message TEXT notnull=0 default= pk=0",
+		"ip_family TEXT notnull=0 default= pk=0",
+		"interface TEXT notnull=0 default= pk=0",
+		"test_mode TEXT notnull=0 default= pk=0",
+		"test_duration REAL notnull=0 default= pk=0",
+		"connections INTEGER notnull=0 default= pk=0",
+		"bytes_used INTEGER notnull=0 default= pk=0",
+		"server_id TEXT notnull=0 default= pk=0",
+		"server_host TEXT notnull=0 default= pk=0",
+		"server_sponsor TEXT notnull=0 default= pk=0",
+		"server_lat REAL notnull=0 default= pk=0",
+		"server_lon REAL notnull=0 default= pk=0",
+		"public_ip TEXT notnull=0 default= pk=0",
+		"client_version TEXT notnull=0 default= pk=0",
+		"backend_version TEXT notnull=0 default= pk=0",
+		"result_key TEXT notnull=0 default= pk=0",
+		"index idx_speedtest_results_interface",
+		"index idx_speedtest_results_key",
+		"index idx_speedtest_results_run",
+		"index idx_speedtest_results_time",
+	}},
+	{"speedtest_samples", []string{
+		"id INTEGER notnull=0 default= pk=1",
+		"result_id INTEGER notnull=1 default= pk=0",
+		"phase TEXT notnull=0 default= pk=0",
+		"seconds REAL notnull=0 default= pk=0",
+		"speed REAL notnull=0 default= pk=0",
+		"result_key TEXT notnull=0 default= pk=0",
+		"index idx_speedtest_samples_key",
+		"index idx_speedtest_samples_result",
+	}},
+	{"browser_results", []string{
+		"id INTEGER notnull=0 default= pk=1",
+		"visitor_ip TEXT notnull=0 default= pk=0",
+		"user_agent TEXT notnull=0 default= pk=0",
+		"latency REAL notnull=0 default= pk=0",
+		"jitter REAL notnull=0 default= pk=0",
+		"download_speed REAL notnull=0 default= pk=0",
+		"upload_speed REAL notnull=0 default= pk=0",
+		"test_time INTEGER notnull=0 default= pk=0",
+	}},
+	{"outages", []string{
+		"id INTEGER notnull=0 default= pk=1",
+		"start_time INTEGER notnull=1 default= pk=0",
+		"end_time INTEGER notnull=0 default= pk=0",
+		"last_failure INTEGER notnull=0 default= pk=0",
+		"duration REAL notnull=0 default= pk=0",
+		"error_message TEXT notnull=0 default= pk=0",
+	}},
+	{"latency_results", []string{
+		"id INTEGER notnull=0 default= pk=1",
+		"target TEXT notnull=1 default= pk=0",
+		"test_time INTEGER notnull=1 default= pk=0",
+		"sent INTEGER notnull=1 default= pk=0",
+		"received INTEGER notnull=1 default= pk=0",
+		"latency_min REAL notnull=0 default= pk=0",
+		"latency_median REAL notnull=0 default= pk=0",
+		"latency_max REAL notnull=0 default= pk=0",
+		"packet_loss REAL notnull=1 default= pk=0",
+		"error_message TEXT notnull=0 default= pk=0",
+		"index idx_latency_results_target_time",
+	}},
+	{"dns_results", []string{
+		"id INTEGER notnull=0 default= pk=1",
+		"run_id TEXT notnull=1 default= pk=0",
+		"resolver TEXT notnull=1 default= pk=0",
+		"domain TEXT notnull=1 default= pk=0",
+		"duration REAL notnull=0 default= pk=0",
+		"error_message TEXT notnull=0 default= pk=0",
+		"test_time INTEGER notnull=1 default= pk=0",
+	}},
+	{"http_probe_results", []string{
+		"id INTEGER notnull=0 default= pk=1",
+		"url TEXT notnull=1 default= pk=0",
+		"status_code INTEGER notnull=0 default= pk=0",
+		"dns_time REAL notnull=1 default= pk=0",
+		"connect_time REAL notnull=1 default= pk=0",
+		"tls_time REAL notnull=1 default= pk=0",
+		"ttfb REAL notnull=0 default= pk=0",
+		"total_time REAL notnull=0 default= pk=0",
+		"bytes INTEGER notnull=1 default= pk=0",
+		"error_message TEXT notnull=0 default= pk=0",
+		"test_time INTEGER notnull=1 default= pk=0",
+	}},
+	{"traceroutes", []string{
+		"id INTEGER notnull=0 default= pk=1",
+		"result_id INTEGER notnull=1 default= pk=0",
+		"target TEXT notnull=1 default= pk=0",
+		"protocol TEXT notnull=1 default= pk=0",
+		"reason TEXT notnull=1 default= pk=0",
+		"reached INTEGER notnull=1 default= pk=0",
+		"error_message TEXT notnull=0 default= pk=0",
+		"test_time INTEGER notnull=1 default= pk=0",
+		"result_key TEXT notnull=0 default= pk=0",
+		"index idx_traceroutes_key",
+	}},
+	{"traceroute_hops", []string{
+		"id INTEGER notnull=0 default= pk=1",
+		"traceroute_id INTEGER notnull=1 default= pk=0",
+		"ttl INTEGER notnull=1 default= pk=0",
+		"address TEXT notnull=0 default= pk=0",
+		"rtt REAL notnull=0 default= pk=0",
+	}},
+	{"schema_version", []string{
+		"version INTEGER notnull=0 default= pk=1",
+		"description TEXT notnull=0 default= pk=0",
+		"applied_at INTEGER notnull=0 default= pk=0",
+	}},
+}
+
+func TestMigratedSchema(t *testing.T) {
+	db := openTestDatabase(t)
+	if err := migrateDatabase(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range migratedSchemas {
+		if got := tableSchema(t, db, want.table); got != strings.Join(want.schema, "\n") {
+			t.Errorf("迁移后%s的结构不同\n实际:\n%s\n期望:\n%s", want.table, got, strings.Join(want.schema, "\n"))
+		}
+	}
+
+	// 所有表都应列出，新增表时同步更新
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(migratedSchemas) {
+		t.Errorf("迁移后有%d个表, 期望 %d", count, len(migratedSchemas))
+	}
+}
+
+func TestRebuildTable(t *testing.T) {
+	tests := []struct {
+		name        string
+		types       map[string]string
+		wantSchema  string
+		wantRebuilt bool
+	}{
+		{
+			name:  "修改列类型",
+			types: map[string]string{"test_time": "INTEGER", "score": "REAL"},
+			wantSchema: strings.Join([]string{
+				"id INTEGER notnull=0 default= pk=1",
+				"test_time INTEGER notnull=1 default= pk=0",
+				"score REAL notnull=0 default=0 pk=0",
+				"note TEXT notnull=0 default='n/a' pk=0",
+				"index idx_items_time",
+			}, "\n"),
+			wantRebuilt: true,
+		},
+		{
+			name:  "已经是目标类型",
+			types: map[string]string{"test_time": "TEXT"},
+			wantSchema: strings.Join([]string{
+				"id INTEGER notnull=0 default= pk=1",
+				"test_time TEXT notnull=1 default= pk=0",
+				"score NUMERIC notnull=0 default=0 pk=0",
+				"note TEXT notnull=0 default='n/a' pk=0",
+				"index idx_items_time",
+			}, "\n"),
+		},
+		{
+			name:  "不存在的列",
+			types: map[string]string{"missing": "INTEGER"},
+			wantSchema: strings.Join([]string{
+				"id INTEGER notnull=0 default= pk=1",
+				"test_time TEXT notnull=1 default= pk=0",
+				"score NUMERIC notnull=0 default=0 pk=0",
+				"note TEXT notnull=0 default='n/a' pk=0",
+				"index idx_items_time",
+			}, "\n"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDatabase(t)
+			setup := []string{
+				"CREATE TABLE items (id INTEGER PRIMARY KEY AUTOINCREMENT, test_time TEXT NOT NULL, score NUMERIC DEFAULT 0, note TEXT DEFAULT 'n/a')",
+				"CREATE INDEX idx_items_time ON items(test_time)",
+				"INSERT INTO items (test_time, score, note) VALUES ('1700000000', 1.5, 'a'), ('1700000060', 2, NULL), ('1700000120', 3, 'c')",
+				// 删除最后一条记录，重建后新记录的ID仍不能与其重复
+				"DELETE FROM items WHERE id = 3",
+			}
+			for _, stmt := range setup {
+				if _, err := db.Exec(stmt); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var before string
+			db.QueryRow("SELECT sql FROM sqlite_master WHERE name = 'items'").Scan(&before)
+
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := rebuildTable(tx, "items", tt.types); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := tableSchema(t, db, "items"); got != tt.wantSchema {
+				t.Errorf("表结构:\n%s\nwant:\n%s", got, tt.wantSchema)
+			}
+			var after string
+			db.QueryRow("SELECT sql FROM sqlite_master WHERE name = 'items'").Scan(&after)
+			if rebuilt := after != before; rebuilt != tt.wantRebuilt {
+				t.Errorf("重建了表: %v, want %v", rebuilt, tt.wantRebuilt)
+			}
+
+			// 数据原样保留，新类型的列按其类型亲和性保存
+			var rows []string
+			result, err := db.Query("SELECT id, test_time, typeof(test_time), score, COALESCE(note, 'NULL') FROM items ORDER BY id")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer result.Close()
+			for result.Next() {
+				var id int64
+				var testTime, timeType, note string
+				var score float64
+				if err := result.Scan(&id, &testTime, &timeType, &score, &note); err != nil {
+					t.Fatal(err)
+				}
+				rows = append(rows, fmt.Sprintf("%d %s %s %g %s", id, testTime, timeType, score, note))
+			}
+			timeType := "text"
+			if tt.types["test_time"] == "INTEGER" {
+				timeType = "integer"
+			}
+			want := []string{
+				"1 1700000000 " + timeType + " 1.5 a",
+				"2 1700000060 " + timeType + " 2 NULL",
+			}
+			if strings.Join(rows, "\n") != strings.Join(want, "\n") {
+				t.Errorf("数据:\n%s\nwant:\n%s", strings.Join(rows, "\n"), strings.Join(want, "\n"))
+			}
+
+			var id int64
+			if err := db.QueryRow("INSERT INTO items (test_time) VALUES ('1700000180') RETURNING id").Scan(&id); err != nil {
+				t.Fatal(err)
+			}
+			if id != 4 {
+				t.Errorf("重建后新记录的ID = %d, want 4", id)
+			}
+		})
+	}
+}
+
+// 查询版本不修改数据库：没有schema_version表时版本为0，也不创建该表
+func TestSchemaVersionReadOnly(t *testing.T) {
+	db := openTestDatabase(t)
+	version, err := schemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Errorf("空数据库的版本 = %d, 期望 0", version)
+	}
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&tables); err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Errorf("查询版本后有%d个表, 期望 0", tables)
+	}
+
+	if err := migrateDatabase(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	if version, err = schemaVersion(db); err != nil || version != latestSchemaVersion() {
+		t.Errorf("迁移后的版本 = %d (%v), 期望 %d", version, err, latestSchemaVersion())
+	}
+}
+
+// 迁移7将schema_version中本地时间字符串的执行时间转换为时间戳，表结构与新建的数据库相同
+func TestAppliedAtTimestamps(t *testing.T) {
+	previous := legacyLocation
+	legacyLocation = time.FixedZone("UTC+8", 8*3600)
+	defer func() { legacyLocation = previous }()
+
+	db := openTestDatabase(t)
+	if err := migrateDatabase(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := tableSchema(t, db, "schema_version")
+
+	// 模拟迁移7之前的版本表
+	setup := []string{
+		"DROP TABLE schema_version",
+		"CREATE TABLE schema_version (version INTEGER PRIMARY KEY, description TEXT, applied_at TEXT)",
+		"INSERT INTO schema_version (version, description, applied_at) VALUES (5, 'v5', '2024-01-02 11:04:05'), (6, 'v6', '2024-01-03 08:00:00')",
+	}
+	for _, stmt := range setup {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Unix()
+	if err := migrateDatabase(db, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := tableSchema(t, db, "schema_version"); got != want {
+		t.Errorf("迁移后schema_version的结构不同\n实际:\n%s\n期望:\n%s", got, want)
+	}
+	wantTimes := map[int]int64{
+		5: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Unix(),
+		6: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC).Unix(),
+	}
+	rows, err := db.Query("SELECT version, applied_at, typeof(applied_at) FROM schema_version WHERE version >= 5 ORDER BY version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		var typ string
+		if err := rows.Scan(&version, &appliedAt, &typ); err != nil {
+			t.Fatal(err)
+		}
+		if typ != "integer" {
+			t.Errorf("版本%d的执行时间类型 = %s, 期望 integer", version, typ)
+		}
+		if want, ok := wantTimes[version]; ok && appliedAt != want {
+			t.Errorf("版本%d的执行时间 = %d, 期望 %d", version, appliedAt, want)
+		}
+		if version == 7 && appliedAt < start {
+			t.Errorf("版本7的执行时间 = %d, 期望不早于 %d", appliedAt, start)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 未配置检测目标时使用的默认目标
+var defaultMonitorTargets = []string{
+	"tcp://223.5.5.5:53",
+	"tcp://1.1.1.1:443",
+	"dns://119.29.29.29/www.baidu.com",
+}
+
+// 断网检测目标，支持以下格式：
+//
+//	tcp://host:port           建立TCP连接
+//	http://... 或 https://...  发送HEAD请求，收到任意响应即视为可达
+//	dns://server[:port]/name  通过指定的DNS服务器解析域名
+type probeTarget struct {
+	raw    string
+	scheme string
+	addr   string // tcp和dns目标的地址
+	name   string // dns目标要解析的域名
+}
+
+// 解析检测目标
+func parseProbeTarget(raw string) (probeTarget, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return probeTarget{}, fmt.Errorf("无效的检测目标%s: %v", raw, err)
+	}
+
+	target := probeTarget{raw: raw, scheme: u.Scheme}
+	switch u.Scheme {
+	case "tcp":
+		if u.Port() == "" {
+			return target, fmt.Errorf("TCP检测目标%s缺少端口", raw)
+		}
+		target.addr = u.Host
+	case "http", "https":
+	case "dns":
+		host, port := splitHostPort(u.Host, "53")
+		target.addr = net.JoinHostPort(host, port)
+		target.name = strings.TrimPrefix(u.Path, "/")
+		if target.name == "" {
+			return target, fmt.Errorf("DNS检测目标%s缺少要解析的域名", raw)
+		}
+	default:
+		return target, fmt.Errorf("不支持的检测目标%s，仅支持tcp、http、https和dns", raw)
+	}
+	return target, nil
+}
+
+// 检测不复用连接，确保每次都真正建立新连接
+var probeHTTPClient = &http.Client{
+	Transport: &http.Transport{DisableKeepAlives: true, Proxy: outboundProxy, DialContext: outboundDialContext},
+	// 不跟随重定向，收到重定向响应即说明网络可达
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// 执行一次检测，不可达时返回错误
+func (t probeTarget) probe(ctx context.Context) error {
+	switch t.scheme {
+	case "tcp":
+		conn, err := dialOutboundTCP(ctx, t.addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "http", "https":
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, t.raw, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := probeHTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	case "dns":
+		resolver := &net.Resolver{
+			PreferGo: true,
+			// UDP查询无法经过代理，响应被截断后改用的TCP查询经过代理
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				if network == "tcp" {
+					return dialOutboundTCP(ctx, t.addr)
+				}
+				return outboundDialContext(ctx, network, t.addr)
+			},
+		}
+		_, err := resolver.LookupHost(ctx, t.name)
+		return err
+	}
+	return fmt.Errorf("不支持的检测目标: %s", t.raw)
+}
+
+// 断网监测：定期检测所有目标，全部不可达且连续达到阈值轮数时记录一次断网
+type outageMonitor struct {
+	targets   []probeTarget
+	interval  time.Duration
+	timeout   time.Duration
+	threshold int
+
+	failures  int       // 连续全部失败的轮数
+	firstFail time.Time // 本次连续失败的开始时间，即断网开始时间
+	outageID  int64     // 进行中的断网记录ID，0表示网络正常
+}
+
+// 根据配置启动断网监测，ctx结束时停止
+func startOutageMonitor(ctx context.Context, cfg MonitorConfig) error {
+	rawTargets := cfg.Targets
+	if len(rawTargets) == 0 {
+		rawTargets = defaultMonitorTargets
+	}
+
+	m := &outageMonitor{
+		interval:  time.Duration(cfg.Interval) * time.Second,
+		timeout:   time.Duration(cfg.Timeout) * time.Second,
+		threshold: cfg.FailureThreshold,
+	}
+	if m.interval <= 0 {
+		m.interval = 5 * time.Second
+	}
+	if m.timeout <= 0 {
+		m.timeout = 3 * time.Second
+	}
+	if m.threshold <= 0 {
+		m.threshold = 2
+	}
+	for _, raw := range rawTargets {
+		target, err := parseProbeTarget(raw)
+		if err != nil {
+			return err
+		}
+		if target.scheme == "dns" && config.Proxy != "" {
+			log.Printf("DNS检测目标%s使用UDP查询，无法经过代理，将直接连接", raw)
+		}
+		m.targets = append(m.targets, target)
+	}
+
+	// 上次运行时未结束的断网，以最后一次检测失败的时间作为结束时间
+	if err := closeDanglingOutages(); err != nil {
+		return err
+	}
+
+	log.Printf("已启动断网监测，间隔%v，检测目标: %s", m.interval, strings.Join(rawTargets, ", "))
+	go m.run(ctx)
+	return nil
+}
+
+func (m *outageMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.check(ctx)
+		}
+	}
+}
+
+// 执行一轮检测并更新断网状态
+func (m *outageMonitor) check(ctx context.Context) {
+	now := time.Now()
+	err := m.probeAll(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err == nil {
+		if m.outageID != 0 {
+			if err := endOutage(m.outageID, now); err != nil {
+				log.Printf("%v", err)
+			}
+			log.Printf("网络已恢复，断网持续%v", now.Sub(m.firstFail).Round(time.Second))
+		}
+		m.failures = 0
+		m.outageID = 0
+		return
+	}
+
+	m.failures++
+	if m.failures == 1 {
+		m.firstFail = now
+	}
+	if m.outageID != 0 {
+		if err := updateOutage(m.outageID, now); err != nil {
+			log.Printf("%v", err)
+		}
+		return
+	}
+	if m.failures >= m.threshold {
+		id, dbErr := startOutage(m.firstFail, now, err)
+		if dbErr != nil {
+			log.Printf("%v", dbErr)
+			return
+		}
+		m.outageID = id
+		log.Printf("检测到断网: %v", err)
+	}
+}
+
+// 并发检测所有目标，任意一个可达即返回nil
+func (m *outageMonitor) probeAll(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	errs := make(chan error, len(m.targets))
+	for _, target := range m.targets {
+		go func(target probeTarget) {
+			if err := target.probe(ctx); err != nil {
+				errs <- fmt.Errorf("%s: %v", target.raw, err)
+				return
+			}
+			errs <- nil
+		}(target)
+	}
+
+	var messages []string
+	for range m.targets {
+		if err := <-errs; err != nil {
+			messages = append(messages, err.Error())
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("所有检测目标均不可达: %s", strings.Join(messages, "; "))
+}
+
+// 记录一次断网开始
+func startOutage(start, lastFailure time.Time, cause error) (int64, error) {
+	db, err := openDatabase()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	res, err := db.Exec("INSERT INTO outages (start_time, last_failure, error_message) VALUES (?, ?, ?)",
+		start.Unix(), lastFailure.Unix(), cause.Error())
+	if err != nil {
+		return 0, fmt.Errorf("插入断网记录失败: %v", err)
+	}
+	return res.LastInsertId()
+}
+
+// 更新断网期间最后一次检测失败的时间
+func updateOutage(id int64, lastFailure time.Time) error {
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("UPDATE outages SET last_failure = ? WHERE id = ?", lastFailure.Unix(), id); err != nil {
+		return fmt.Errorf("更新断网记录失败: %v", err)
+	}
+	return nil
+}
+
+// 记录断网结束
+func endOutage(id int64, end time.Time) error {
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("UPDATE outages SET end_time = ?, duration = ? - start_time WHERE id = ?", end.Unix(), end.Unix(), id)
+	if err != nil {
+		return fmt.Errorf("更新断网记录失败: %v", err)
+	}
+	return nil
+}
+
+// 结束上次运行时遗留的断网记录
+func closeDanglingOutages() error {
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("UPDATE outages SET end_time = last_failure, duration = last_failure - start_time WHERE end_time IS NULL")
+	if err != nil {
+		return fmt.Errorf("更新断网记录失败: %v", err)
+	}
+	return nil
+}
+
+// 获取最近days天（默认7天）的断网记录和每天的断网总时长
+func outagesHandler(w http.ResponseWriter, r *http.Request) {
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days <= 0 {
+		days = 7
+	}
+	// 按显示时区划分每一天
+	now := time.Now().In(displayLocation)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, displayLocation)
+	since := today.AddDate(0, 0, -(days - 1))
+
+	db, err := openDatabase()
+	if err != nil {
+		log.Printf("%v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, start_time, end_time, error_message FROM outages WHERE end_time IS NULL OR end_time >= ? ORDER BY start_time",
+		since.Unix())
+	if err != nil {
+		log.Printf("查询断网记录失败: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// 每天的断网总时长(秒)，跨天的断网按天拆分
+	downtime := make([]float64, days)
+	outages := []map[string]interface{}{}
+	for rows.Next() {
+		var id int64
+		var startTime int64
+		var endTime sql.NullInt64
+		var errorMessage sql.NullString
+		if err := rows.Scan(&id, &startTime, &endTime, &errorMessage); err != nil {
+			log.Printf("扫描数据失败: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		start := time.Unix(startTime, 0)
+		end := now // 进行中的断网计算到当前时间
+		var endValue interface{}
+		if endTime.Valid {
+			end = time.Unix(endTime.Int64, 0)
+			endValue = formatAPITime(endTime.Int64)
+		}
+		for i := range downtime {
+			dayStart := since.AddDate(0, 0, i)
+			dayEnd := dayStart.AddDate(0, 0, 1)
+			overlapStart, overlapEnd := start, end
+			if overlapStart.Before(dayStart) {
+				overlapStart = dayStart
+			}
+			if overlapEnd.After(dayEnd) {
+				overlapEnd = dayEnd
+			}
+			if overlapEnd.After(overlapStart) {
+				downtime[i] += overlapEnd.Sub(overlapStart).Seconds()
+			}
+		}
+
+		outages = append(outages, map[string]interface{}{
+			"id":            id,
+			"start_time":    formatAPITime(startTime),
+			"end_time":      endValue,
+			"duration":      end.Sub(start).Seconds(),
+			"error_message": nullString(errorMessage),
+		})
+	}
+
+	daily := []map[string]interface{}{}
+	for i, seconds := range downtime {
+		daily = append(daily, map[string]interface{}{
+			"date":     since.AddDate(0, 0, i).Format("2006-01-02"),
+			"downtime": seconds,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"outages": outages,
+		"daily":   daily,
+	})
+}
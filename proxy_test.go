@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 在本机监听，对每个连接执行handle
+func listenTest(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// 把目标连接与客户端连接对接
+func relay(client net.Conn, target string) {
+	conn, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	go io.Copy(conn, client)
+	io.Copy(client, conn)
+}
+
+// 只接受CONNECT请求的HTTP代理，wantAuth不为空时校验Proxy-Authorization
+func testHTTPProxy(wantAuth string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != wantAuth {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		relay(conn, req.Host)
+	}
+}
+
+// SOCKS5代理，user不为空时要求用户名密码认证
+func testSOCKS5Proxy(user, password string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		methods := make([]byte, header[1])
+		io.ReadFull(conn, methods)
+		if user == "" {
+			conn.Write([]byte{0x05, 0x00})
+		} else {
+			conn.Write([]byte{0x05, 0x02})
+			io.ReadFull(conn, header)
+			name := make([]byte, header[1])
+			io.ReadFull(conn, name)
+			io.ReadFull(conn, header[:1])
+			pass := make([]byte, header[0])
+			io.ReadFull(conn, pass)
+			if string(name) != user || string(pass) != password {
+				conn.Write([]byte{0x01, 0x01})
+				return
+			}
+			conn.Write([]byte{0x01, 0x00})
+		}
+
+		request := make([]byte, 4)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		var host string
+		switch request[3] {
+		case 0x01:
+			ip := make([]byte, net.IPv4len)
+			io.ReadFull(conn, ip)
+			host = net.IP(ip).String()
+		case 0x03:
+			io.ReadFull(conn, header[:1])
+			name := make([]byte, header[0])
+			io.ReadFull(conn, name)
+			host = string(name)
+		default:
+			return
+		}
+		port := make([]byte, 2)
+		io.ReadFull(conn, port)
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+		relay(conn, net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	}
+}
+
+func TestDialProxy(t *testing.T) {
+	// 回显服务器，用域名和IP两种方式访问
+	target := listenTest(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	_, port, _ := net.SplitHostPort(target)
+
+	tests := []struct {
+		name    string
+		proxy   string
+		target  string
+		wantErr bool
+	}{
+		{"HTTP代理", "http://" + listenTest(t, testHTTPProxy("")), target, false},
+		{"HTTP代理认证", "http://user:pass@" + listenTest(t, testHTTPProxy("Basic dXNlcjpwYXNz")), target, false},
+		{"HTTP代理认证失败", "http://user:wrong@" + listenTest(t, testHTTPProxy("Basic dXNlcjpwYXNz")), target, true},
+		{"SOCKS5代理", "socks5://" + listenTest(t, testSOCKS5Proxy("", "")), target, false},
+		{"SOCKS5代理解析域名", "socks5h://" + listenTest(t, testSOCKS5Proxy("", "")), net.JoinHostPort("localhost", port), false},
+		{"SOCKS5代理认证", "socks5://user:pass@" + listenTest(t, testSOCKS5Proxy("user", "pass")), target, false},
+		{"SOCKS5代理认证失败", "socks5://user:wrong@" + listenTest(t, testSOCKS5Proxy("user", "pass")), target, true},
+		{"SOCKS5代理要求认证", "socks5://" + listenTest(t, testSOCKS5Proxy("user", "pass")), target, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := parseProxy(tt.proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var d net.Dialer
+			conn, err := dialProxy(ctx, d.DialContext, proxy, tt.target)
+			if tt.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("应返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.WriteString(conn, "ping"); err != nil {
+				t.Fatal(err)
+			}
+			reply := make([]byte, 4)
+			if _, err := io.ReadFull(conn, reply); err != nil {
+				t.Fatal(err)
+			}
+			if string(reply) != "ping" {
+				t.Errorf("通过隧道收到%q", reply)
+			}
+		})
+	}
+}
+
+// 代理不响应时按ctx的截止时间返回
+func TestDialProxyTimeout(t *testing.T) {
+	proxy, _ := parseProxy("socks5://" + listenTest(t, func(conn net.Conn) { io.Copy(io.Discard, conn) }))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var d net.Dialer
+	start := time.Now()
+	if _, err := dialProxy(ctx, d.DialContext, proxy, "127.0.0.1:53"); err == nil {
+		t.Fatal("应返回错误")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("%v后才返回", elapsed)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// 一轮测速的结果：每个服务器一条记录，并按地址族汇总测速成功的服务器的中位数和最佳值
+type RunResult struct {
+	ID        string
+	TestTime  time.Time
+	Results   []*MeasureResult
+	Succeeded []*MeasureResult // 测速成功的结果
+	Summaries []*RunSummary    // 每个地址族一项，按测速顺序排列
+}
+
+// 一轮测速中一个地址族的汇总，IPv4和IPv6的速度和延迟差别可能很大，不放在一起统计
+type RunSummary struct {
+	Family    string // v4、v6，旧版本的记录为空
+	Succeeded []*MeasureResult
+
+	DownloadMedian float64
+	DownloadBest   float64
+	UploadMedian   float64
+	UploadBest     float64
+	LatencyMedian  time.Duration
+	LatencyBest    time.Duration
+}
+
+// 生成测速轮次ID：时间戳加随机后缀，按字符串排序即按时间排序
+func newRunID() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return time.Now().Format("20060102150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// 汇总一轮测速中各服务器的结果
+func newRunResult(id string, results []*MeasureResult) *RunResult {
+	run := &RunResult{ID: id, Results: results}
+	families := map[string]*RunSummary{}
+	for _, result := range results {
+		if result.Err != nil {
+			continue
+		}
+		run.Succeeded = append(run.Succeeded, result)
+		if run.TestTime.IsZero() || result.TestTime.Before(run.TestTime) {
+			run.TestTime = result.TestTime
+		}
+		summary, ok := families[result.Family]
+		if !ok {
+			summary = &RunSummary{Family: result.Family}
+			families[result.Family] = summary
+			run.Summaries = append(run.Summaries, summary)
+		}
+		summary.Succeeded = append(summary.Succeeded, result)
+	}
+	for _, summary := range run.Summaries {
+		summary.aggregate()
+	}
+	return run
+}
+
+// 计算一个地址族的中位数和最佳值
+func (s *RunSummary) aggregate() {
+	var downloads, uploads []float64
+	var latencies []time.Duration
+	s.LatencyBest = s.Succeeded[0].Latency
+	for _, result := range s.Succeeded {
+		downloads = append(downloads, result.DownloadMbps)
+		uploads = append(uploads, result.UploadMbps)
+		latencies = append(latencies, result.Latency)
+		if result.DownloadMbps > s.DownloadBest {
+			s.DownloadBest = result.DownloadMbps
+		}
+		if result.UploadMbps > s.UploadBest {
+			s.UploadBest = result.UploadMbps
+		}
+		if result.Latency < s.LatencyBest {
+			s.LatencyBest = result.Latency
+		}
+	}
+	s.DownloadMedian = medianFloat(downloads)
+	s.UploadMedian = medianFloat(uploads)
+	s.LatencyMedian = medianDuration(latencies)
+}
+
+// 本轮同时测试了IPv4和IPv6时，汇总的输出需要标明地址族，如"(IPv4)"
+func (r *RunResult) familyLabel(summary *RunSummary) string {
+	if len(r.Summaries) <= 1 {
+		return ""
+	}
+	return "(" + familyName(summary.Family) + ")"
+}
+
+// 本轮没有任何服务器测速成功时返回第一个失败原因
+func (r *RunResult) err() error {
+	if len(r.Succeeded) > 0 {
+		return nil
+	}
+	for _, result := range r.Results {
+		if result.Err != nil {
+			return result.Err
+		}
+	}
+	return fmt.Errorf("没有测速结果")
+}
+
+// 计算浮点数的中位数
+func medianFloat(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// 查询最近limit轮测速的记录，按时间从新到旧排列
+// 每轮有多条记录，按记录数限制会在边界处截断一轮，因此逐步扩大查询范围，直到取完limit个完整的轮次
+func recentRunRecords(limit int) ([]*ResultRecord, error) {
+	for n := limit; ; n *= 2 {
+		records, err := store.Query(ResultFilter{Status: StatusOK, Limit: n})
+		if err != nil {
+			return nil, err
+		}
+
+		// 已经出现第limit+1轮时前limit轮都是完整的；记录不足n条时已经取完全部记录
+		seen := map[string]bool{}
+		var kept []*ResultRecord
+		for _, record := range records {
+			runID := record.runID()
+			if !seen[runID] {
+				if limit > 0 && len(seen) == limit {
+					return kept, nil
+				}
+				seen[runID] = true
+			}
+			kept = append(kept, record)
+		}
+		if limit <= 0 || len(records) < n {
+			return kept, nil
+		}
+	}
+}
+
+// 获取最近的测速轮次及每轮中各服务器的结果，按时间从旧到新排列
+// 旧版本的记录没有run_id，每条记录视为单独的一轮
+func runsHandler(limit int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		records, err := recentRunRecords(limit)
+		if err != nil {
+			log.Printf("%v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		// 按轮次分组，保持查询顺序
+		var runIDs []string
+		timestamps := map[string]string{}
+		grouped := map[string][]*MeasureResult{}
+		for _, record := range records {
+			runID := record.runID()
+			if _, ok := grouped[runID]; !ok {
+				runIDs = append(runIDs, runID)
+				timestamps[runID] = formatAPITime(record.TestTime)
+			}
+			grouped[runID] = append(grouped[runID], record.result())
+		}
+		reverseStringSlice(runIDs)
+
+		runs := []map[string]interface{}{}
+		for _, runID := range runIDs {
+			// 查询结果从新到旧，反转后按测速顺序汇总
+			results := grouped[runID]
+			for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+				results[i], results[j] = results[j], results[i]
+			}
+			run := newRunResult(runID, results)
+			// 同一轮测速使用相同的参数，测速模式不包括的方向返回null
+			first := run.Results[0]
+			download, upload := modeIncludes(first.Mode, PhaseDownload), modeIncludes(first.Mode, PhaseUpload)
+			speed := func(mbps float64, included bool) interface{} {
+				if !included {
+					return nil
+				}
+				return mbps
+			}
+			servers := []map[string]interface{}{}
+			for _, result := range run.Results {
+				servers = append(servers, map[string]interface{}{
+					"id":             result.ID,
+					"server_name":    result.ServerName,
+					"server_id":      result.ServerID,
+					"public_ip":      result.PublicIP,
+					"ip_family":      result.Family,
+					"download_speed": speed(result.DownloadMbps, download),
+					"upload_speed":   speed(result.UploadMbps, upload),
+					"latency":        result.Latency.Milliseconds(),
+				})
+			}
+			families := []map[string]interface{}{}
+			for _, summary := range run.Summaries {
+				families = append(families, map[string]interface{}{
+					"ip_family":       summary.Family,
+					"count":           len(summary.Succeeded),
+					"download_median": speed(summary.DownloadMedian, download),
+					"download_best":   speed(summary.DownloadBest, download),
+					"upload_median":   speed(summary.UploadMedian, upload),
+					"upload_best":     speed(summary.UploadBest, upload),
+					"latency_median":  summary.LatencyMedian.Milliseconds(),
+					"latency_best":    summary.LatencyBest.Milliseconds(),
+				})
+			}
+			runs = append(runs, map[string]interface{}{
+				"run_id":    run.ID,
+				"test_time": timestamps[runID],
+				"params":    formatTestParams(first.Mode, first.Duration.Seconds(), int64(first.Connections)),
+				"servers":   servers,
+				"families":  families,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(runs)
+	}
+}
+
+// 按出口、服务器和测速参数统计历史测速结果，便于比较不同出口到同一服务器的速度，参数不同的结果分开统计
+func serverStatsHandler(w http.ResponseWriter, r *http.Request) {
+	serverStats, err := store.ServerStats(ResultFilter{})
+	if err != nil {
+		log.Printf("%v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	stats := []map[string]interface{}{}
+	for _, st := range serverStats {
+		stats = append(stats, map[string]interface{}{
+			"interface":     st.Interface,
+			"server_name":   st.ServerName,
+			"server_id":     st.ServerID,
+			"params":        formatTestParams(stringValue(st.Mode), floatValue(st.Duration), intValue(st.Connections)),
+			"count":         st.Count,
+			"failures":      st.Failures,
+			"download_avg":  st.DownloadAvg,
+			"download_best": st.DownloadBest,
+			"upload_avg":    st.UploadAvg,
+			"upload_best":   st.UploadBest,
+			"latency_avg":   st.LatencyAvg,
+			"latency_best":  st.LatencyBest,
+			"last_test":     formatAPITime(st.LastTest),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// 返回可选的出口：配置的出口及历史记录中出现过的出口
+func interfacesHandler(w http.ResponseWriter, r *http.Request) {
+	recorded, err := store.Interfaces()
+	if err != nil {
+		log.Printf("%v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// configured为可以手动测速的出口，recorded为可以筛选图表的出口
+	configured := []string{}
+	for _, u := range config.Uplinks {
+		configured = append(configured, u.label())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"configured": configured,
+		"recorded":   recorded,
+	})
+}
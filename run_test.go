@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 同时测试IPv4和IPv6时按地址族分别汇总，失败的结果不参与汇总
+func TestNewRunResult(t *testing.T) {
+	result := func(family string, download float64, latency time.Duration, offset int64) *MeasureResult {
+		return &MeasureResult{Family: family, DownloadMbps: download, UploadMbps: download / 10, Latency: latency, TestTime: time.Unix(testBaseTime+offset, 0)}
+	}
+	failed := result(FamilyIPv6, 0, 0, 0)
+	failed.Err = errors.New("connection reset")
+	run := newRunResult("run1", []*MeasureResult{
+		result(FamilyIPv4, 100, 20*time.Millisecond, 10),
+		result(FamilyIPv4, 300, 10*time.Millisecond, 20),
+		result(FamilyIPv4, 200, 30*time.Millisecond, 30),
+		result(FamilyIPv6, 50, 40*time.Millisecond, 40),
+		failed,
+	})
+
+	if len(run.Succeeded) != 4 {
+		t.Errorf("测速成功的结果 = %d, 期望 4", len(run.Succeeded))
+	}
+	if !run.TestTime.Equal(time.Unix(testBaseTime+10, 0)) {
+		t.Errorf("测速时间 = %v, 期望第一个成功结果的时间", run.TestTime)
+	}
+	if len(run.Summaries) != 2 {
+		t.Fatalf("地址族汇总 = %d, 期望 2", len(run.Summaries))
+	}
+
+	v4, v6 := run.Summaries[0], run.Summaries[1]
+	if v4.Family != FamilyIPv4 || len(v4.Succeeded) != 3 || v4.DownloadMedian != 200 || v4.DownloadBest != 300 ||
+		v4.UploadMedian != 20 || v4.UploadBest != 30 || v4.LatencyMedian != 20*time.Millisecond || v4.LatencyBest != 10*time.Millisecond {
+		t.Errorf("IPv4汇总 = %+v", v4)
+	}
+	if v6.Family != FamilyIPv6 || len(v6.Succeeded) != 1 || v6.DownloadMedian != 50 || v6.DownloadBest != 50 ||
+		v6.LatencyMedian != 40*time.Millisecond || v6.LatencyBest != 40*time.Millisecond {
+		t.Errorf("IPv6汇总 = %+v", v6)
+	}
+	if run.familyLabel(v6) != "(IPv6)" {
+		t.Errorf("地址族标签 = %q", run.familyLabel(v6))
+	}
+
+	single := newRunResult("run2", []*MeasureResult{result(FamilyAuto, 100, 20*time.Millisecond, 0)})
+	if len(single.Summaries) != 1 || single.familyLabel(single.Summaries[0]) != "" {
+		t.Errorf("单一地址族的汇总 = %+v", single.Summaries)
+	}
+}
+
+// 按轮次而不是记录数限制，不会在边界处截断一轮
+func TestRecentRunRecords(t *testing.T) {
+	s, err := newJSONLStore(filepath.Join(t.TempDir(), "results.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := store
+	store = s
+	defer func() { store = previous }()
+
+	// run1有1条记录，run2有3条，run3有2条
+	var offset int64
+	for _, run := range []struct {
+		id    string
+		count int
+	}{{"run1", 1}, {"run2", 3}, {"run3", 2}} {
+		for i := 0; i < run.count; i++ {
+			offset++
+			if _, err := store.Insert(&ResultRecord{RunID: ptr(run.id), Status: StatusOK, ServerName: "s1", TestTime: testBaseTime + offset}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		limit int
+		want  []string
+	}{
+		{1, []string{"run3", "run3"}},
+		{2, []string{"run3", "run3", "run2", "run2", "run2"}},
+		{3, []string{"run3", "run3", "run2", "run2", "run2", "run1"}},
+		{10, []string{"run3", "run3", "run2", "run2", "run2", "run1"}},
+		{0, []string{"run3", "run3", "run2", "run2", "run2", "run1"}},
+	}
+	for _, tt := range tests {
+		records, err := recentRunRecords(tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, record := range records {
+			got = append(got, record.runID())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("limit=%d: 轮次 = %v, 期望 %v", tt.limit, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// 出站连接绑定的源地址，用于在有多个出口时指定测速使用的网卡或IP
+type sourceAddr struct {
+	name   string   // 配置的网卡名称或IP地址
+	device string   // 网卡名称，指定IP地址时为空
+	ips    []net.IP // 可用作源地址的本机IP
+}
+
+// 解析网卡名称或本机IP地址，为空时返回nil（由系统路由决定）
+func parseSource(source string) (*sourceAddr, error) {
+	if source == "" {
+		return nil, nil
+	}
+	if ip := net.ParseIP(source); ip != nil {
+		return &sourceAddr{name: source, ips: []net.IP{ip}}, nil
+	}
+
+	iface, err := net.InterfaceByName(source)
+	if err != nil {
+		return nil, fmt.Errorf("无效的源地址或网卡%s: %v", source, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("获取网卡%s的地址失败: %v", source, err)
+	}
+	s := &sourceAddr{name: source, device: iface.Name}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		// 链路本地地址无法访问公网上的测速服务器
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		s.ips = append(s.ips, ipNet.IP)
+	}
+	if len(s.ips) == 0 {
+		return nil, fmt.Errorf("网卡%s没有可用的IP地址", source)
+	}
+	return s, nil
+}
+
+// 返回指定地址族的源IP，family为空时返回第一个地址（优先IPv4）
+func (s *sourceAddr) ip(family string) net.IP {
+	if family == FamilyAuto {
+		if ip := s.ip(FamilyIPv4); ip != nil {
+			return ip
+		}
+		return s.ip(FamilyIPv6)
+	}
+	for _, ip := range s.ips {
+		if familyOf(ip) == family {
+			return ip
+		}
+	}
+	return nil
+}
+
+// net.Dialer的控制函数：按解析后的网络（如 tcp4、udp6）选择同一地址族的源IP并绑定
+func (s *sourceAddr) control(network, address string, c syscall.RawConn) error {
+	network, _, _ = strings.Cut(network, ":")
+	family := FamilyIPv4
+	if strings.HasSuffix(network, "6") {
+		family = FamilyIPv6
+	}
+	ip := s.ip(family)
+	if ip == nil {
+		return fmt.Errorf("%s没有%s地址，无法连接%s", s.name, familyName(family), address)
+	}
+
+	var bindErr error
+	err := c.Control(func(fd uintptr) {
+		bindErr = s.bind(fd, ip)
+	})
+	if err != nil {
+		return err
+	}
+	return bindErr
+}
+
+// 将套接字绑定到源IP（端口由系统分配），指定了网卡时同时绑定到该网卡
+func (s *sourceAddr) bind(fd uintptr, ip net.IP) error {
+	var sa syscall.Sockaddr
+	if ip4 := ip.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		sa6 := &syscall.SockaddrInet6{}
+		copy(sa6.Addr[:], ip.To16())
+		sa = sa6
+	}
+	if err := bindSocket(fd, s.device, sa); err != nil {
+		return fmt.Errorf("绑定源地址%s失败: %v", ip, err)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// IP_BIND_ADDRESS_NO_PORT（Linux 4.2+），部分架构的syscall包中没有该常量
+const ipBindAddressNoPort = 0x18
+
+// 绑定套接字的源地址，指定了网卡时先通过SO_BINDTODEVICE绑定到该网卡，
+// 使连接从该网卡发出，不依赖按源地址选择路由的策略路由
+func bindSocket(fd uintptr, device string, sa syscall.Sockaddr) error {
+	if device != "" {
+		// Linux 5.7以前SO_BINDTODEVICE需要CAP_NET_RAW权限。没有权限时只绑定源地址，连接可能从其他网卡发出，
+		// 测得的不是指定出口的结果，因此不继续测速
+		err := syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+		if err == syscall.EPERM {
+			return fmt.Errorf("绑定到网卡%s需要root或CAP_NET_RAW权限，也可改用该网卡的IP地址作为源地址: %v", device, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// 推迟到connect时再分配端口，否则bind分配的端口不能复用TIME_WAIT状态的端口，
+	// 测速建立大量连接后会耗尽可用端口；旧内核不支持时忽略
+	syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, ipBindAddressNoPort, 1)
+	return syscall.Bind(int(fd), sa)
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"syscall"
+)
+
+// 绑定套接字的源地址，不支持绑定到网卡，出口由按源地址选择的路由决定
+func bindSocket(fd uintptr, device string, sa syscall.Sockaddr) error {
+	return syscall.Bind(int(fd), sa)
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"syscall"
+)
+
+// 绑定套接字的源地址，Windows按源地址选择出口网卡
+func bindSocket(fd uintptr, device string, sa syscall.Sockaddr) error {
+	return syscall.Bind(syscall.Handle(fd), sa)
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// 测速结果的存储类型
+const (
+	StoreSQLite   = "sqlite"   // 与其他数据保存在同一个SQLite数据库中（默认）
+	StorePostgres = "postgres" // PostgreSQL数据库
+	StoreJSONL    = "jsonl"    // 只追加的JSON Lines文件，每行一条测速结果
+)
+
+// 全局的测速结果存储，启动时按配置打开
+var store ResultStore
+
+// 测速结果的存储。断网和延迟监测等其他数据总是保存在SQLite数据库中；吞吐量采样和traceroute
+// 只在测速结果也保存在SQLite中时保存（见storeIsSQLite），通过测速结果的唯一标识（ResultRecord.Key）关联
+type ResultStore interface {
+	// 保存一条测速结果，返回分配的记录ID
+	Insert(record *ResultRecord) (int64, error)
+	// 查询符合条件的测速结果，按测速时间从新到旧排列
+	Query(filter ResultFilter) ([]*ResultRecord, error)
+	// 按出口、服务器和测速参数汇总符合条件的测速结果，没有服务器信息的记录不参与汇总
+	ServerStats(filter ResultFilter) ([]*ServerStats, error)
+	// 汇总符合条件的测速结果的数量、流量和时间范围
+	Summary(filter ResultFilter) (*ResultSummary, error)
+	// 返回测速结果中出现过的出口，按名称排列
+	Interfaces() ([]string, error)
+	// 删除符合条件的测速结果，返回删除的记录数
+	Delete(filter ResultFilter) (int64, error)
+	Close() error
+}
+
+// 保存的一条测速结果，字段与speedtest_results表的列对应，可能为NULL的列使用指针
+type ResultRecord struct {
+	ID               int64    `json:"id"`
+	RunID            *string  `json:"run_id,omitempty"`     // 旧记录没有轮次ID
+	Key              *string  `json:"result_key,omitempty"` // 唯一标识，见MeasureResult.Key
+	Status           string   `json:"status"`
+	FailedPhase      *string  `json:"failed_phase,omitempty"`
+	ErrorMessage     *string  `json:"error_message,omitempty"`
+	Backend          *string  `json:"backend,omitempty"`
+	Family           *string  `json:"ip_family,omitempty"`
+	Interface        *string  `json:"interface,omitempty"`
+	ISP              string   `json:"isp"`
+	ServerName       string   `json:"server_name"`
+	ServerCountry    string   `json:"server_country"`
+	ServerDistance   float64  `json:"server_distance"`
+	Latency          int64    `json:"latency"` // 平均延迟(ms)
+	Jitter           *float64 `json:"jitter,omitempty"`
+	LatencyMin       *float64 `json:"latency_min,omitempty"`
+	LatencyMax       *float64 `json:"latency_max,omitempty"`
+	LatencyMedian    *float64 `json:"latency_median,omitempty"`
+	PacketLoss       *float64 `json:"packet_loss,omitempty"`
+	LatencyDownload  *float64 `json:"latency_download,omitempty"`
+	LatencyUpload    *float64 `json:"latency_upload,omitempty"`
+	BufferbloatGrade *string  `json:"bufferbloat_grade,omitempty"`
+	DownloadSpeed    *float64 `json:"download_speed,omitempty"`
+	UploadSpeed      *float64 `json:"upload_speed,omitempty"`
+	TestTime         int64    `json:"test_time"` // UTC Unix时间戳
+	Mode             *string  `json:"test_mode,omitempty"`
+	Duration         *float64 `json:"test_duration,omitempty"` // 秒
+	Connections      *int64   `json:"connections,omitempty"`
+	BytesUsed        *int64   `json:"bytes_used,omitempty"`
+	ServerID         *string  `json:"server_id,omitempty"`
+	ServerHost       *string  `json:"server_host,omitempty"`
+	ServerSponsor    *string  `json:"server_sponsor,omitempty"`
+	ServerLat        *float64 `json:"server_lat,omitempty"`
+	ServerLon        *float64 `json:"server_lon,omitempty"`
+	PublicIP         *string  `json:"public_ip,omitempty"`
+	ClientVersion    *string  `json:"client_version,omitempty"`
+	BackendVersion   *string  `json:"backend_version,omitempty"`
+}
+
+// 测速结果的查询条件，零值的字段不作为条件
+type ResultFilter struct {
+	ID          int64
+	From, To    time.Time // 测速时间范围[From, To)
+	Interface   string
+	ServerName  string
+	Status      string
+	Mode        string
+	Duration    float64 // 测试时长(秒)
+	Connections int
+	Limit       int // 最多返回的记录数，对汇总和删除无效
+}
+
+// 一个出口到一个服务器在相同测速参数下的统计，速度和延迟只统计测速成功的记录
+type ServerStats struct {
+	Interface    *string
+	ServerName   string
+	ServerID     *string
+	Mode         *string
+	Duration     *float64
+	Connections  *int64
+	Count        int64
+	Failures     int64
+	DownloadAvg  *float64
+	DownloadBest *float64
+	UploadAvg    *float64
+	UploadBest   *float64
+	LatencyAvg   *float64
+	LatencyBest  *float64
+	LastTest     int64
+}
+
+// 测速结果的数量、消耗的流量和时间范围，没有记录时First和Last为0
+type ResultSummary struct {
+	Count     int64
+	BytesUsed int64
+	First     int64
+	Last      int64
+}
+
+// 将测速结果转换为保存的记录，未测量或不适用的值保存为NULL
+func newResultRecord(result *MeasureResult) *ResultRecord {
+	record := &ResultRecord{
+		RunID:            optionalString(result.RunID),
+		Key:              optionalString(result.Key),
+		Status:           result.Status,
+		FailedPhase:      optionalString(result.FailedPhase),
+		Backend:          optionalString(result.Backend),
+		Family:           optionalString(result.Family),
+		Interface:        optionalString(result.Interface),
+		ISP:              result.ISP,
+		ServerName:       result.ServerName,
+		ServerCountry:    result.ServerCountry,
+		ServerDistance:   result.ServerDistance,
+		Latency:          result.Latency.Milliseconds(),
+		Jitter:           optionalFloat(durationMs(result.Jitter), true),
+		LatencyMin:       optionalFloat(durationMs(result.LatencyMin), true),
+		LatencyMax:       optionalFloat(durationMs(result.LatencyMax), true),
+		LatencyMedian:    optionalFloat(durationMs(result.LatencyMedian), true),
+		PacketLoss:       optionalFloat(result.PacketLoss, result.PacketLoss >= 0),
+		LatencyDownload:  optionalFloat(durationMs(result.LatencyDownload), result.LatencyDownload > 0),
+		LatencyUpload:    optionalFloat(durationMs(result.LatencyUpload), result.LatencyUpload > 0),
+		BufferbloatGrade: optionalString(result.BufferbloatGrade),
+		DownloadSpeed:    optionalFloat(result.DownloadMbps, modeIncludes(result.Mode, PhaseDownload)),
+		UploadSpeed:      optionalFloat(result.UploadMbps, modeIncludes(result.Mode, PhaseUpload)),
+		TestTime:         result.TestTime.Unix(),
+		Mode:             &result.Mode,
+		Duration:         optionalFloat(result.Duration.Seconds(), true),
+		Connections:      optionalInt(int64(result.Connections), true),
+		BytesUsed:        optionalInt(result.Bytes, true),
+		ServerID:         optionalString(result.ServerID),
+		ServerHost:       optionalString(result.ServerHost),
+		ServerSponsor:    optionalString(result.ServerSponsor),
+		PublicIP:         optionalString(result.PublicIP),
+		ClientVersion:    optionalString(result.ClientVersion),
+		BackendVersion:   optionalString(result.BackendVersion),
+	}
+	if result.Err != nil {
+		record.ErrorMessage = optionalString(result.Err.Error())
+	}
+	// 经纬度无法解析（如自定义服务器的"?"）时保存为NULL
+	if v, err := strconv.ParseFloat(result.ServerLat, 64); err == nil {
+		record.ServerLat = &v
+	}
+	if v, err := strconv.ParseFloat(result.ServerLon, 64); err == nil {
+		record.ServerLon = &v
+	}
+	return record
+}
+
+// 转换为测速结果，用于按测速结果计算汇总值；NULL转换为零值，丢包率为NULL时为-1
+func (r *ResultRecord) result() *MeasureResult {
+	result := &MeasureResult{
+		ID:             r.ID,
+		RunID:          stringValue(r.RunID),
+		Key:            stringValue(r.Key),
+		Status:         r.Status,
+		FailedPhase:    stringValue(r.FailedPhase),
+		Backend:        stringValue(r.Backend),
+		ISP:            r.ISP,
+		ServerName:     r.ServerName,
+		ServerCountry:  r.ServerCountry,
+		ServerDistance: r.ServerDistance,
+		ServerHost:     stringValue(r.ServerHost),
+		ServerID:       stringValue(r.ServerID),
+		ServerSponsor:  stringValue(r.ServerSponsor),
+		PublicIP:       stringValue(r.PublicIP),
+		Family:         stringValue(r.Family),
+		Interface:      stringValue(r.Interface),
+		Latency:        time.Duration(r.Latency) * time.Millisecond,
+		PacketLoss:     -1,
+		DownloadMbps:   floatValue(r.DownloadSpeed),
+		UploadMbps:     floatValue(r.UploadSpeed),
+		TestTime:       time.Unix(r.TestTime, 0),
+		Mode:           stringValue(r.Mode),
+		Duration:       time.Duration(floatValue(r.Duration) * float64(time.Second)),
+		Connections:    int(intValue(r.Connections)),
+		ClientVersion:  stringValue(r.ClientVersion),
+		BackendVersion: stringValue(r.BackendVersion),
+		Bytes:          intValue(r.BytesUsed),
+	}
+	if r.ErrorMessage != nil {
+		result.Err = errors.New(*r.ErrorMessage)
+	}
+	if r.PacketLoss != nil {
+		result.PacketLoss = *r.PacketLoss
+	}
+	return result
+}
+
+// 测速参数的简短描述，见formatTestParams
+func (r *ResultRecord) params() string {
+	return formatTestParams(stringValue(r.Mode), floatValue(r.Duration), intValue(r.Connections))
+}
+
+// 记录所属的轮次，旧版本的记录没有轮次ID，每条记录视为单独的一轮
+func (r *ResultRecord) runID() string {
+	if r.RunID != nil {
+		return *r.RunID
+	}
+	return "r" + strconv.FormatInt(r.ID, 10)
+}
+
+// 记录是否符合查询条件，供不支持SQL的存储使用
+func (f ResultFilter) match(r *ResultRecord) bool {
+	switch {
+	case f.ID != 0 && r.ID != f.ID:
+	case !f.From.IsZero() && r.TestTime < f.From.Unix():
+	case !f.To.IsZero() && r.TestTime >= f.To.Unix():
+	case f.Interface != "" && stringValue(r.Interface) != f.Interface:
+	case f.ServerName != "" && r.ServerName != f.ServerName:
+	case f.Status != "" && r.Status != f.Status:
+	case f.Mode != "" && stringValue(r.Mode) != f.Mode:
+	case f.Duration != 0 && floatValue(r.Duration) != f.Duration:
+	case f.Connections != 0 && intValue(r.Connections) != int64(f.Connections):
+	default:
+		return true
+	}
+	return false
+}
+
+// 打开配置的测速结果存储
+func openResultStore(cfg StoreConfig) (ResultStore, error) {
+	var store ResultStore
+	var err error
+	switch cfg.Type {
+	case "", StoreSQLite:
+		store = newSQLiteStore()
+	case StorePostgres:
+		store, err = newPostgresStore(cfg.DSN, cfg.ReadOnly)
+	case StoreJSONL:
+		store, err = newJSONLStore(cfg.DSN)
+	default:
+		return nil, fmt.Errorf("未知的存储类型: %s，仅支持sqlite、postgres和jsonl", cfg.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ReadOnly {
+		store = readOnlyStore{store}
+	}
+	return store, nil
+}
+
+// 只读的存储，用于只展示其他实例写入的结果，保存和删除时返回错误
+type readOnlyStore struct {
+	ResultStore
+}
+
+// 测速结果存储是否为只读。只读时不执行测速，以免测完才发现无法保存，白白消耗流量
+func storeReadOnly() bool {
+	_, ok := store.(readOnlyStore)
+	return ok
+}
+
+func (readOnlyStore) Insert(*ResultRecord) (int64, error) {
+	return 0, fmt.Errorf("测速结果存储为只读，无法保存")
+}
+
+func (readOnlyStore) Delete(ResultFilter) (int64, error) {
+	return 0, fmt.Errorf("测速结果存储为只读，无法删除")
+}
+
+// 字符串为空时返回nil，即保存为NULL
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// valid为false时返回nil
+func optionalFloat(v float64, valid bool) *float64 {
+	if !valid {
+		return nil
+	}
+	return &v
+}
+
+// valid为false时返回nil
+func optionalInt(v int64, valid bool) *int64 {
+	if !valid {
+		return nil
+	}
+	return &v
+}
+
+// 返回指针指向的值，nil时返回零值
+func stringValue(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
+
+func floatValue(p *float64) float64 {
+	if p == nil {
+		return 0
+	}
+	return *p
+}
+
+func intValue(p *int64) int64 {
+	if p == nil {
+		return 0
+	}
+	return *p
+}
+
+// 转换为sql.Null*类型，用于复用formatNullFloat等格式化函数
+func toNullString(p *string) sql.NullString {
+	return sql.NullString{String: stringValue(p), Valid: p != nil}
+}
+
+func toNullFloat(p *float64) sql.NullFloat64 {
+	return sql.NullFloat64{Float64: floatValue(p), Valid: p != nil}
+}
+
+// -delete-before：删除指定日期之前的测速结果，以及SQLite数据库中关联的吞吐量采样和traceroute
+func deleteResultsBefore(date string) {
+	before, err := time.ParseInLocation("2006-01-02", date, displayLocation)
+	if err != nil {
+		log.Fatalf("无效的日期: %s，格式为YYYY-MM-DD", date)
+	}
+	deleted, err := deleteResults(ResultFilter{To: before})
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	fmt.Printf("已删除%s之前的%d条测速结果\n", date, deleted)
+}
+
+// 测速结果是否保存在SQLite数据库中。吞吐量采样和traceroute只与SQLite中的测速结果一起保存，
+// 测速结果保存在其他存储中时不保存这些数据，以免关联数据分散在各实例的本地数据库中
+func storeIsSQLite() bool {
+	s := store
+	if readOnly, ok := s.(readOnlyStore); ok {
+		s = readOnly.ResultStore
+	}
+	local, ok := s.(*sqlStore)
+	return ok && local.db == nil
+}
+
+// 删除关联数据的语句，%s为要删除的测速结果的唯一标识
+var detailDeletes = []string{
+	"DELETE FROM traceroute_hops WHERE traceroute_id IN (SELECT id FROM traceroutes WHERE result_key IN (%s))",
+	"DELETE FROM traceroutes WHERE result_key IN (%s)",
+	"DELETE FROM speedtest_samples WHERE result_key IN (%s)",
+}
+
+// 删除符合条件的测速结果，返回删除的测速结果数。测速结果保存在SQLite中时在同一事务中一并删除其吞吐量采样和traceroute；
+// 使用其他存储时没有关联数据，只从存储中删除测速结果
+func deleteResults(filter ResultFilter) (int64, error) {
+	if storeReadOnly() {
+		return 0, fmt.Errorf("测速结果存储为只读，无法删除")
+	}
+	if !storeIsSQLite() {
+		return store.Delete(filter)
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer tx.Rollback()
+
+	where, args := filter.where()
+	keys := "SELECT result_key FROM speedtest_results" + where
+	for _, stmt := range detailDeletes {
+		if _, err := tx.Exec(fmt.Sprintf(stmt, keys), args...); err != nil {
+			return 0, fmt.Errorf("删除关联数据失败: %v", err)
+		}
+	}
+	res, err := tx.Exec("DELETE FROM speedtest_results"+where, args...)
+	if err != nil {
+		return 0, fmt.Errorf("删除测速结果失败: %v", err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("删除测速结果失败: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("提交事务失败: %v", err)
+	}
+	return deleted, nil
+}
+
+// 按记录ID查询测速结果的唯一标识，记录不存在时返回空字符串
+func lookupResultKey(id int64) (string, error) {
+	records, err := store.Query(ResultFilter{ID: id})
+	if err != nil || len(records) == 0 {
+		return "", err
+	}
+	return stringValue(records[0].Key), nil
+}
+
+// -db-info：测速结果不保存在SQLite数据库中时，输出存储的类型和记录数
+func printStoreInfo(cfg StoreConfig) {
+	if cfg.Type == "" || cfg.Type == StoreSQLite {
+		return
+	}
+	s, err := openResultStore(cfg)
+	if err != nil {
+		log.Fatalf("打开测速结果存储失败: %v", err)
+	}
+	defer s.Close()
+	summary, err := s.Summary(ResultFilter{})
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	fmt.Printf("\n测速结果存储: %s\n记录数: %d\n", cfg.Type, summary.Count)
+	if summary.Count > 0 {
+		fmt.Printf("测速记录时间: %s 至 %s\n", formatLocalTime(summary.First), formatLocalTime(summary.Last))
+	}
+}
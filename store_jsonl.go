@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 测速结果保存在JSON Lines文件中，每行一条记录，新的测速结果追加到文件末尾。
+// 查询时读取整个文件，适合记录不多、不便运行数据库的嵌入式设备，或只读地展示其他实例导出的结果。
+//
+// 写入时对旁边的锁文件（path.lock）加文件锁，定时测速和Web界面等多个进程可以写入同一个文件。
+// 锁文件中保存最后分配的记录ID，分配ID时不需要读取整个文件。文件只追加，不支持删除记录
+type jsonlStore struct {
+	path string
+	mu   sync.Mutex // 串行化本进程内的写入，文件锁串行化不同进程的写入
+}
+
+// 打开JSONL文件存储，path为空时使用数据库所在目录下的results.jsonl
+func newJSONLStore(path string) (*jsonlStore, error) {
+	if path == "" {
+		path = filepath.Join(filepath.Dir(DBPath), "results.jsonl")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("创建数据目录失败: %v", err)
+	}
+	return &jsonlStore{path: path}, nil
+}
+
+// 读取文件中的所有记录，文件不存在时返回空列表
+func (s *jsonlStore) load() ([]*ResultRecord, error) {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("打开测速结果文件失败: %v", err)
+	}
+	defer file.Close()
+
+	var records []*ResultRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		record := &ResultRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return nil, fmt.Errorf("解析测速结果文件第%d行失败: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取测速结果文件失败: %v", err)
+	}
+	return records, nil
+}
+
+// 读取符合条件的记录，按测速时间从新到旧排列
+func (s *jsonlStore) matching(filter ResultFilter) ([]*ResultRecord, error) {
+	records, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	matched := []*ResultRecord{}
+	for _, r := range records {
+		if filter.match(r) {
+			matched = append(matched, r)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if matched[i].TestTime != matched[j].TestTime {
+			return matched[i].TestTime > matched[j].TestTime
+		}
+		return matched[i].ID > matched[j].ID
+	})
+	return matched, nil
+}
+
+// 在文件锁内执行fn，lock为锁文件
+func (s *jsonlStore) locked(fn func(lock *os.File) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lock, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("打开锁文件失败: %v", err)
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return fmt.Errorf("锁定测速结果文件失败: %v", err)
+	}
+	defer unlockFile(lock)
+	return fn(lock)
+}
+
+// 分配下一个记录ID并保存到锁文件，须在文件锁内调用。锁文件为空（新建或旧版本创建的文件）时按文件中最大的ID递增
+func (s *jsonlStore) nextID(lock *os.File) (int64, error) {
+	data, err := io.ReadAll(lock)
+	if err != nil {
+		return 0, fmt.Errorf("读取锁文件失败: %v", err)
+	}
+	last, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		records, err := s.load()
+		if err != nil {
+			return 0, err
+		}
+		last = 0
+		for _, r := range records {
+			last = max(last, r.ID)
+		}
+	}
+
+	id := last + 1
+	if err := lock.Truncate(0); err != nil {
+		return 0, fmt.Errorf("写入锁文件失败: %v", err)
+	}
+	if _, err := lock.WriteAt([]byte(strconv.FormatInt(id, 10)), 0); err != nil {
+		return 0, fmt.Errorf("写入锁文件失败: %v", err)
+	}
+	return id, nil
+}
+
+func (s *jsonlStore) Insert(r *ResultRecord) (int64, error) {
+	record := *r
+	err := s.locked(func(lock *os.File) error {
+		id, err := s.nextID(lock)
+		if err != nil {
+			return err
+		}
+		record.ID = id
+
+		line, err := json.Marshal(&record)
+		if err != nil {
+			return fmt.Errorf("编码测速结果失败: %v", err)
+		}
+		file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("打开测速结果文件失败: %v", err)
+		}
+		defer file.Close()
+		// 整行一次写入，读取的进程不会读到半行
+		if _, err := file.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("写入测速结果失败: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return record.ID, nil
+}
+
+func (s *jsonlStore) Query(filter ResultFilter) ([]*ResultRecord, error) {
+	records, err := s.matching(filter)
+	if err != nil {
+		return nil, err
+	}
+	if filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[:filter.Limit]
+	}
+	return records, nil
+}
+
+func (s *jsonlStore) ServerStats(filter ResultFilter) ([]*ServerStats, error) {
+	records, err := s.matching(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// 按出口、服务器和测速参数分组，与SQL存储的GROUP BY相同
+	type statsKey struct {
+		iface, server, mode string
+		duration            float64
+		connections         int64
+	}
+	type accumulator struct {
+		stats                               *ServerStats
+		downloadSum, uploadSum, latencySum  float64
+		downloadCount, uploadCount, okCount int
+	}
+	groups := map[statsKey]*accumulator{}
+	var order []statsKey
+	for _, r := range records {
+		if r.ServerName == "" {
+			continue
+		}
+		key := statsKey{stringValue(r.Interface), r.ServerName, stringValue(r.Mode), floatValue(r.Duration), intValue(r.Connections)}
+		acc, ok := groups[key]
+		if !ok {
+			acc = &accumulator{stats: &ServerStats{
+				Interface: r.Interface, ServerName: r.ServerName, Mode: r.Mode, Duration: r.Duration, Connections: r.Connections,
+			}}
+			groups[key] = acc
+			order = append(order, key)
+		}
+		st := acc.stats
+		st.Count++
+		st.LastTest = max(st.LastTest, r.TestTime)
+		if r.ServerID != nil && (st.ServerID == nil || *r.ServerID > *st.ServerID) {
+			st.ServerID = r.ServerID
+		}
+		if r.Status != StatusOK {
+			st.Failures++
+			continue
+		}
+		if r.DownloadSpeed != nil {
+			acc.downloadSum += *r.DownloadSpeed
+			acc.downloadCount++
+			st.DownloadBest = maxFloat(st.DownloadBest, *r.DownloadSpeed)
+		}
+		if r.UploadSpeed != nil {
+			acc.uploadSum += *r.UploadSpeed
+			acc.uploadCount++
+			st.UploadBest = maxFloat(st.UploadBest, *r.UploadSpeed)
+		}
+		latency := float64(r.Latency)
+		acc.latencySum += latency
+		acc.okCount++
+		if st.LatencyBest == nil || latency < *st.LatencyBest {
+			st.LatencyBest = &latency
+		}
+	}
+
+	stats := []*ServerStats{}
+	for _, key := range order {
+		acc := groups[key]
+		if acc.downloadCount > 0 {
+			acc.stats.DownloadAvg = optionalFloat(acc.downloadSum/float64(acc.downloadCount), true)
+		}
+		if acc.uploadCount > 0 {
+			acc.stats.UploadAvg = optionalFloat(acc.uploadSum/float64(acc.uploadCount), true)
+		}
+		if acc.okCount > 0 {
+			acc.stats.LatencyAvg = optionalFloat(acc.latencySum/float64(acc.okCount), true)
+		}
+		stats = append(stats, acc.stats)
+	}
+	sort.SliceStable(stats, func(i, j int) bool { return stats[i].Count > stats[j].Count })
+	return stats, nil
+}
+
+// 返回较大的值，当前值为nil时返回v
+func maxFloat(current *float64, v float64) *float64 {
+	if current == nil || v > *current {
+		return &v
+	}
+	return current
+}
+
+func (s *jsonlStore) Summary(filter ResultFilter) (*ResultSummary, error) {
+	records, err := s.matching(filter)
+	if err != nil {
+		return nil, err
+	}
+	summary := &ResultSummary{Count: int64(len(records))}
+	for _, r := range records {
+		summary.BytesUsed += intValue(r.BytesUsed)
+		if summary.First == 0 || r.TestTime < summary.First {
+			summary.First = r.TestTime
+		}
+		summary.Last = max(summary.Last, r.TestTime)
+	}
+	return summary, nil
+}
+
+func (s *jsonlStore) Interfaces() ([]string, error) {
+	records, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	interfaces := []string{}
+	seen := map[string]bool{}
+	for _, r := range records {
+		if r.Interface != nil && !seen[*r.Interface] {
+			seen[*r.Interface] = true
+			interfaces = append(interfaces, *r.Interface)
+		}
+	}
+	sort.Strings(interfaces)
+	return interfaces, nil
+}
+
+// 文件只追加，不支持删除：重写文件会丢失其他进程同时追加的记录，也会改变文件的权限
+func (s *jsonlStore) Delete(filter ResultFilter) (int64, error) {
+	return 0, fmt.Errorf("JSONL存储只追加，不支持删除测速结果，如需清理请停止测速后自行编辑%s", s.path)
+}
+
+func (s *jsonlStore) Close() error {
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// speedtest_results表的列，顺序与Query中Scan的参数一致
+const resultColumns = `id, run_id, result_key, status, failed_phase, error_message, backend, ip_family, interface, isp, server_name, server_country, server_distance,
+	latency, jitter, latency_min, latency_max, latency_median, packet_loss, latency_download, latency_upload, bufferbloat_grade, download_speed, upload_speed,
+	test_time, test_mode, test_duration, connections, bytes_used, server_id, server_host, server_sponsor, server_lat, server_lon, public_ip, client_version, backend_version`
+
+// 通过SQL保存测速结果，SQLite和PostgreSQL共用，两者的SQL只有占位符不同
+type sqlStore struct {
+	db       *sql.DB // PostgreSQL的连接池；SQLite为nil，与其他代码一样每次操作时打开数据库
+	postgres bool    // 使用$1、$2……形式的占位符
+}
+
+// 测速结果保存在SQLite数据库的speedtest_results表中，表结构由migrate.go维护
+func newSQLiteStore() *sqlStore {
+	return &sqlStore{}
+}
+
+// 返回数据库连接和用完后的释放函数
+func (s *sqlStore) conn() (*sql.DB, func(), error) {
+	if s.db != nil {
+		return s.db, func() {}, nil
+	}
+	db, err := openDatabase()
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, func() { db.Close() }, nil
+}
+
+// 将?占位符转换为当前数据库的形式
+func (s *sqlStore) rebind(query string) string {
+	if !s.postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// 根据查询条件生成WHERE子句
+func (f ResultFilter) where(conditions ...string) (string, []interface{}) {
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, arg)
+	}
+	if f.ID != 0 {
+		add("id = ?", f.ID)
+	}
+	if !f.From.IsZero() {
+		add("test_time >= ?", f.From.Unix())
+	}
+	if !f.To.IsZero() {
+		add("test_time < ?", f.To.Unix())
+	}
+	if f.Interface != "" {
+		add("interface = ?", f.Interface)
+	}
+	if f.ServerName != "" {
+		add("server_name = ?", f.ServerName)
+	}
+	if f.Status != "" {
+		add("status = ?", f.Status)
+	}
+	if f.Mode != "" {
+		add("test_mode = ?", f.Mode)
+	}
+	if f.Duration != 0 {
+		add("test_duration = ?", f.Duration)
+	}
+	if f.Connections != 0 {
+		add("connections = ?", f.Connections)
+	}
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func (s *sqlStore) Insert(r *ResultRecord) (int64, error) {
+	db, release, err := s.conn()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	insertSQL := `
+	INSERT INTO speedtest_results (run_id, result_key, status, failed_phase, error_message, backend, ip_family, interface, isp, server_name, server_country, server_distance,
+		latency, jitter, latency_min, latency_max, latency_median, packet_loss, latency_download, latency_upload, bufferbloat_grade, download_speed, upload_speed,
+		test_time, test_mode, test_duration, connections, bytes_used, server_id, server_host, server_sponsor, server_lat, server_lon, public_ip, client_version, backend_version)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	RETURNING id
+	`
+	var id int64
+	err = db.QueryRow(s.rebind(insertSQL), r.RunID, r.Key, r.Status, r.FailedPhase, r.ErrorMessage, r.Backend, r.Family, r.Interface, r.ISP, r.ServerName, r.ServerCountry, r.ServerDistance,
+		r.Latency, r.Jitter, r.LatencyMin, r.LatencyMax, r.LatencyMedian, r.PacketLoss, r.LatencyDownload, r.LatencyUpload, r.BufferbloatGrade, r.DownloadSpeed, r.UploadSpeed,
+		r.TestTime, r.Mode, r.Duration, r.Connections, r.BytesUsed, r.ServerID, r.ServerHost, r.ServerSponsor, r.ServerLat, r.ServerLon, r.PublicIP, r.ClientVersion, r.BackendVersion).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("插入数据失败: %v", err)
+	}
+	return id, nil
+}
+
+func (s *sqlStore) Query(filter ResultFilter) ([]*ResultRecord, error) {
+	db, release, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	where, args := filter.where()
+	query := "SELECT " + resultColumns + " FROM speedtest_results" + where + " ORDER BY test_time DESC, id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	rows, err := db.Query(s.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("查询数据失败: %v", err)
+	}
+	defer rows.Close()
+
+	records := []*ResultRecord{}
+	for rows.Next() {
+		r := &ResultRecord{}
+		err := rows.Scan(&r.ID, &r.RunID, &r.Key, &r.Status, &r.FailedPhase, &r.ErrorMessage, &r.Backend, &r.Family, &r.Interface, &r.ISP, &r.ServerName, &r.ServerCountry, &r.ServerDistance,
+			&r.Latency, &r.Jitter, &r.LatencyMin, &r.LatencyMax, &r.LatencyMedian, &r.PacketLoss, &r.LatencyDownload, &r.LatencyUpload, &r.BufferbloatGrade, &r.DownloadSpeed, &r.UploadSpeed,
+			&r.TestTime, &r.Mode, &r.Duration, &r.Connections, &r.BytesUsed, &r.ServerID, &r.ServerHost, &r.ServerSponsor, &r.ServerLat, &r.ServerLon, &r.PublicIP, &r.ClientVersion, &r.BackendVersion)
+		if err != nil {
+			return nil, fmt.Errorf("扫描数据失败: %v", err)
+		}
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("遍历结果失败: %v", err)
+	}
+	return records, nil
+}
+
+func (s *sqlStore) ServerStats(filter ResultFilter) ([]*ServerStats, error) {
+	db, release, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// 开始测速前就失败的记录没有服务器信息，不参与统计
+	where, args := filter.where("server_name != ''")
+	rows, err := db.Query(s.rebind(`
+	SELECT interface, server_name, MAX(server_id), test_mode, test_duration, connections, COUNT(*), SUM(CASE WHEN status != 'ok' THEN 1 ELSE 0 END),
+		AVG(CASE WHEN status = 'ok' THEN download_speed END), MAX(CASE WHEN status = 'ok' THEN download_speed END),
+		AVG(CASE WHEN status = 'ok' THEN upload_speed END), MAX(CASE WHEN status = 'ok' THEN upload_speed END),
+		AVG(CASE WHEN status = 'ok' THEN latency END), MIN(CASE WHEN status = 'ok' THEN latency END),
+		MAX(test_time)
+	FROM speedtest_results`+where+` GROUP BY interface, server_name, test_mode, test_duration, connections ORDER BY COUNT(*) DESC`), args...)
+	if err != nil {
+		return nil, fmt.Errorf("查询数据失败: %v", err)
+	}
+	defer rows.Close()
+
+	stats := []*ServerStats{}
+	for rows.Next() {
+		st := &ServerStats{}
+		err := rows.Scan(&st.Interface, &st.ServerName, &st.ServerID, &st.Mode, &st.Duration, &st.Connections, &st.Count, &st.Failures,
+			&st.DownloadAvg, &st.DownloadBest, &st.UploadAvg, &st.UploadBest, &st.LatencyAvg, &st.LatencyBest, &st.LastTest)
+		if err != nil {
+			return nil, fmt.Errorf("扫描数据失败: %v", err)
+		}
+		stats = append(stats, st)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("遍历结果失败: %v", err)
+	}
+	return stats, nil
+}
+
+func (s *sqlStore) Summary(filter ResultFilter) (*ResultSummary, error) {
+	db, release, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	where, args := filter.where()
+	summary := &ResultSummary{}
+	err = db.QueryRow(s.rebind("SELECT COUNT(*), COALESCE(SUM(bytes_used), 0), COALESCE(MIN(test_time), 0), COALESCE(MAX(test_time), 0) FROM speedtest_results"+where), args...).
+		Scan(&summary.Count, &summary.BytesUsed, &summary.First, &summary.Last)
+	if err != nil {
+		return nil, fmt.Errorf("汇总测速结果失败: %v", err)
+	}
+	return summary, nil
+}
+
+func (s *sqlStore) Interfaces() ([]string, error) {
+	db, release, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rows, err := db.Query("SELECT DISTINCT interface FROM speedtest_results WHERE interface IS NOT NULL ORDER BY interface")
+	if err != nil {
+		return nil, fmt.Errorf("查询数据失败: %v", err)
+	}
+	defer rows.Close()
+
+	interfaces := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("扫描数据失败: %v", err)
+		}
+		interfaces = append(interfaces, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("遍历结果失败: %v", err)
+	}
+	return interfaces, nil
+}
+
+func (s *sqlStore) Delete(filter ResultFilter) (int64, error) {
+	db, release, err := s.conn()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	where, args := filter.where()
+	res, err := db.Exec(s.rebind("DELETE FROM speedtest_results"+where), args...)
+	if err != nil {
+		return 0, fmt.Errorf("删除测速结果失败: %v", err)
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
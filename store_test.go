@@ -0,0 +1,457 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 设置该环境变量后同时对PostgreSQL存储执行测试，测试会清空该数据库中的speedtest_results表，
+// 请使用专门的测试数据库，如 postgres://speed@localhost/speed_test?sslmode=disable
+const testPostgresDSNEnv = "SPEED_TEST_POSTGRES_DSN"
+
+// 测试记录的起始时间
+const testBaseTime = 1700000000
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// 覆盖分组、筛选和汇总的测试记录，按测速时间从旧到新排列
+func testRecords() []*ResultRecord {
+	full := func(runID string, status string, download, upload *float64, latency int64, bytes int64, offset int64) *ResultRecord {
+		return &ResultRecord{
+			RunID:         ptr(runID),
+			Key:           ptr(runID + "/1"),
+			Status:        status,
+			Backend:       ptr(BackendSpeedtest),
+			Interface:     ptr("a"),
+			ServerName:    "s1",
+			ServerCountry: "CN",
+			ServerID:      ptr("1001"),
+			Latency:       latency,
+			DownloadSpeed: download,
+			UploadSpeed:   upload,
+			TestTime:      testBaseTime + offset,
+			Mode:          ptr(ModeFull),
+			Duration:      ptr(10.0),
+			Connections:   ptr(int64(4)),
+			BytesUsed:     ptr(bytes),
+		}
+	}
+	failed := full("run3", StatusFailed, nil, nil, 0, 500, 120)
+	failed.FailedPhase = ptr(PhaseDownload)
+	failed.ErrorMessage = ptr("connection reset")
+	return []*ResultRecord{
+		full("run1", StatusOK, ptr(100.0), ptr(10.0), 20, 1000, 0),
+		full("run2", StatusOK, ptr(200.0), ptr(30.0), 10, 2000, 60),
+		failed,
+		{
+			RunID: ptr("run4"), Key: ptr("run4/1"), Status: StatusOK, Interface: ptr("b"), ServerName: "s2",
+			Latency: 5, TestTime: testBaseTime + 180, Mode: ptr(ModePing), Duration: ptr(10.0), Connections: ptr(int64(4)), BytesUsed: ptr(int64(10)),
+		},
+		// 开始测速前就失败，没有服务器和出口信息
+		{RunID: ptr("run5"), Key: ptr("run5/1"), Status: StatusFailed, FailedPhase: ptr(PhaseSetup), TestTime: testBaseTime + 240},
+	}
+}
+
+// 所有ResultStore实现共同遵守的行为
+func testResultStore(t *testing.T, s ResultStore) {
+	records := testRecords()
+	var ids []int64
+	for _, r := range records {
+		id, err := s.Insert(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) > 0 && id <= ids[len(ids)-1] {
+			t.Fatalf("记录ID应递增: %v, %d", ids, id)
+		}
+		ids = append(ids, id)
+		r.ID = id
+	}
+
+	t.Run("Query", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			filter ResultFilter
+			want   []int // records的下标，按测速时间从新到旧
+		}{
+			{"全部", ResultFilter{}, []int{4, 3, 2, 1, 0}},
+			{"记录ID", ResultFilter{ID: ids[1]}, []int{1}},
+			{"出口", ResultFilter{Interface: "a"}, []int{2, 1, 0}},
+			{"状态", ResultFilter{Status: StatusOK}, []int{3, 1, 0}},
+			{"时间范围", ResultFilter{From: time.Unix(testBaseTime+60, 0), To: time.Unix(testBaseTime+180, 0)}, []int{2, 1}},
+			{"服务器和测速参数", ResultFilter{ServerName: "s1", Mode: ModeFull, Duration: 10, Connections: 4, Status: StatusOK}, []int{1, 0}},
+			{"参数不同", ResultFilter{ServerName: "s1", Connections: 8}, nil},
+			{"数量限制", ResultFilter{Limit: 2}, []int{4, 3}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				got, err := s.Query(tt.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got) != len(tt.want) {
+					t.Fatalf("返回%d条记录，want %d", len(got), len(tt.want))
+				}
+				for i, index := range tt.want {
+					if !reflect.DeepEqual(got[i], records[index]) {
+						t.Errorf("第%d条记录:\ngot  %+v\nwant %+v", i, got[i], records[index])
+					}
+				}
+			})
+		}
+	})
+
+	t.Run("ServerStats", func(t *testing.T) {
+		stats, err := s.ServerStats(ResultFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []*ServerStats{
+			{
+				Interface: ptr("a"), ServerName: "s1", ServerID: ptr("1001"), Mode: ptr(ModeFull), Duration: ptr(10.0), Connections: ptr(int64(4)),
+				Count: 3, Failures: 1, DownloadAvg: ptr(150.0), DownloadBest: ptr(200.0), UploadAvg: ptr(20.0), UploadBest: ptr(30.0),
+				LatencyAvg: ptr(15.0), LatencyBest: ptr(10.0), LastTest: testBaseTime + 120,
+			},
+			{
+				Interface: ptr("b"), ServerName: "s2", Mode: ptr(ModePing), Duration: ptr(10.0), Connections: ptr(int64(4)),
+				Count: 1, LatencyAvg: ptr(5.0), LatencyBest: ptr(5.0), LastTest: testBaseTime + 180,
+			},
+		}
+		if !reflect.DeepEqual(stats, want) {
+			t.Errorf("got:")
+			for _, st := range stats {
+				t.Errorf("  %+v", *st)
+			}
+		}
+
+		stats, err = s.ServerStats(ResultFilter{Interface: "b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats) != 1 || stats[0].ServerName != "s2" {
+			t.Errorf("按出口筛选: got %d组", len(stats))
+		}
+	})
+
+	t.Run("Summary", func(t *testing.T) {
+		tests := []struct {
+			filter ResultFilter
+			want   ResultSummary
+		}{
+			{ResultFilter{}, ResultSummary{Count: 5, BytesUsed: 3510, First: testBaseTime, Last: testBaseTime + 240}},
+			{ResultFilter{Interface: "a", From: time.Unix(testBaseTime+60, 0)}, ResultSummary{Count: 2, BytesUsed: 2500, First: testBaseTime + 60, Last: testBaseTime + 120}},
+			{ResultFilter{Interface: "c"}, ResultSummary{}},
+		}
+		for _, tt := range tests {
+			got, err := s.Summary(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Errorf("Summary(%+v) = %+v, want %+v", tt.filter, *got, tt.want)
+			}
+		}
+	})
+
+	t.Run("Interfaces", func(t *testing.T) {
+		got, err := s.Interfaces()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Interfaces() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		filter := ResultFilter{To: time.Unix(testBaseTime+120, 0)}
+		// JSONL文件只追加，删除返回错误且不修改文件
+		if _, ok := s.(*jsonlStore); ok {
+			if _, err := s.Delete(filter); err == nil {
+				t.Error("JSONL存储删除记录没有返回错误")
+			}
+			if remaining, err := s.Query(ResultFilter{}); err != nil || len(remaining) != len(ids) {
+				t.Errorf("删除失败后剩余%d条记录 (%v), want %d", len(remaining), err, len(ids))
+			}
+			return
+		}
+		deleted, err := s.Delete(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != 2 {
+			t.Errorf("删除了%d条记录，want 2", deleted)
+		}
+		if deleted, err := s.Delete(filter); err != nil || deleted != 0 {
+			t.Errorf("再次删除: %d, %v", deleted, err)
+		}
+		remaining, err := s.Query(ResultFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(remaining) != 3 || remaining[2].ID != ids[2] {
+			t.Errorf("删除后剩余%d条记录", len(remaining))
+		}
+
+		// 删除后新记录的ID不与已删除的记录重复
+		id, err := s.Insert(testRecords()[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id <= ids[len(ids)-1] {
+			t.Errorf("删除后分配的记录ID %d 不大于之前的 %d", id, ids[len(ids)-1])
+		}
+	})
+}
+
+func TestSQLiteStore(t *testing.T) {
+	db := openTestDatabase(t)
+	if err := migrateDatabase(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	s := newSQLiteStore()
+	defer s.Close()
+	testResultStore(t, s)
+}
+
+func TestJSONLStore(t *testing.T) {
+	s, err := newJSONLStore(filepath.Join(t.TempDir(), "results.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testResultStore(t, s)
+}
+
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv(testPostgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("未设置%s，跳过PostgreSQL存储的测试", testPostgresDSNEnv)
+	}
+	s, err := newPostgresStore(dsn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// 连接时升级到最新版本，再次连接时不重复执行迁移，只读连接只检查版本
+	var version int
+	if err := s.db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if want := postgresMigrations[len(postgresMigrations)-1].version; version != want {
+		t.Errorf("PostgreSQL数据库版本 = %d, want %d", version, want)
+	}
+	for _, readOnly := range []bool{false, true} {
+		again, err := newPostgresStore(dsn, readOnly)
+		if err != nil {
+			t.Fatalf("再次连接(readOnly=%v): %v", readOnly, err)
+		}
+		again.Close()
+	}
+
+	if _, err := s.db.Exec("TRUNCATE speedtest_results RESTART IDENTITY"); err != nil {
+		t.Fatal(err)
+	}
+	testResultStore(t, s)
+}
+
+// 多个进程（这里用多个独立的存储实例模拟）同时追加时，记录ID不重复，记录不丢失
+func TestJSONLStoreConcurrentInsert(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	const writers, inserts = 4, 25
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		s, err := newJSONLStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < inserts; j++ {
+				if _, err := s.Insert(&ResultRecord{Status: StatusOK, TestTime: testBaseTime}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	s, err := newJSONLStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := s.Query(ResultFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != writers*inserts {
+		t.Fatalf("文件中有%d条记录，want %d", len(records), writers*inserts)
+	}
+	seen := map[int64]bool{}
+	for _, r := range records {
+		if seen[r.ID] {
+			t.Fatalf("记录ID %d 重复", r.ID)
+		}
+		seen[r.ID] = true
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := "SELECT * FROM speedtest_results WHERE interface = ? AND test_time >= ? LIMIT ?"
+	if got := (&sqlStore{}).rebind(query); got != query {
+		t.Errorf("SQLite不应修改占位符: %s", got)
+	}
+	want := "SELECT * FROM speedtest_results WHERE interface = $1 AND test_time >= $2 LIMIT $3"
+	if got := (&sqlStore{postgres: true}).rebind(query); got != want {
+		t.Errorf("rebind() = %s, want %s", got, want)
+	}
+}
+
+func TestResultFilterWhere(t *testing.T) {
+	tests := []struct {
+		name       string
+		filter     ResultFilter
+		conditions []string
+		want       string
+		args       []interface{}
+	}{
+		{"无条件", ResultFilter{}, nil, "", nil},
+		{"额外条件", ResultFilter{}, []string{"server_name != ''"}, " WHERE server_name != ''", nil},
+		{
+			"所有条件",
+			ResultFilter{ID: 7, From: time.Unix(100, 0), To: time.Unix(200, 0), Interface: "a", ServerName: "s1", Status: StatusOK, Mode: ModeFull, Duration: 10, Connections: 4, Limit: 5},
+			nil,
+			" WHERE id = ? AND test_time >= ? AND test_time < ? AND interface = ? AND server_name = ? AND status = ? AND test_mode = ? AND test_duration = ? AND connections = ?",
+			[]interface{}{int64(7), int64(100), int64(200), "a", "s1", StatusOK, ModeFull, 10.0, 4},
+		},
+		{
+			"额外条件在前",
+			ResultFilter{Interface: "a"},
+			[]string{"server_name != ''"},
+			" WHERE server_name != '' AND interface = ?",
+			[]interface{}{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, args := tt.filter.where(tt.conditions...)
+			if got != tt.want {
+				t.Errorf("where() = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args = %v, want %v", args, tt.args)
+			}
+		})
+	}
+}
+
+// 删除测速结果时一并删除按唯一标识关联的吞吐量采样和traceroute，不影响其他结果的关联数据
+func TestDeleteResults(t *testing.T) {
+	db := openTestDatabase(t)
+	if err := migrateDatabase(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	previous := store
+	store = newSQLiteStore()
+	defer func() { store = previous }()
+
+	// 记录ID与本存储中的记录相同、唯一标识不同的结果
+	other := &MeasureResult{ID: 1, Key: "other/1"}
+	saveDetails := func(result *MeasureResult) {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := saveThroughputSamples(tx, result, []ThroughputSample{{Phase: PhaseDownload, Seconds: 1, Mbps: 100}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		trace := &TracerouteResult{ResultID: result.ID, ResultKey: result.Key, Target: "example.com:80", Protocol: "udp", Reason: "test",
+			Hops: []TracerouteHop{{TTL: 1, Addr: "192.0.2.1", RTT: time.Millisecond}}, TestTime: time.Unix(testBaseTime, 0)}
+		if err := saveTraceroute(trace); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saveDetails(other)
+
+	for _, r := range testRecords() {
+		id, err := store.Insert(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saveDetails(&MeasureResult{ID: id, Key: *r.Key})
+	}
+
+	deleted, err := deleteResults(ResultFilter{To: time.Unix(testBaseTime+120, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Errorf("删除了%d条测速结果，want 2", deleted)
+	}
+
+	count := func(query string, args ...interface{}) int {
+		var n int
+		if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	for _, key := range []string{"run1/1", "run2/1"} {
+		if n := count("SELECT COUNT(*) FROM speedtest_samples WHERE result_key = ?", key) + count("SELECT COUNT(*) FROM traceroutes WHERE result_key = ?", key); n != 0 {
+			t.Errorf("%s的关联数据没有删除", key)
+		}
+	}
+	for _, key := range []string{"other/1", "run3/1", "run4/1", "run5/1"} {
+		if n := count("SELECT COUNT(*) FROM speedtest_samples WHERE result_key = ?", key); n != 1 {
+			t.Errorf("%s的吞吐量采样被误删", key)
+		}
+		if n := count("SELECT COUNT(*) FROM traceroutes WHERE result_key = ?", key); n != 1 {
+			t.Errorf("%s的traceroute被误删", key)
+		}
+	}
+	if n := count("SELECT COUNT(*) FROM traceroute_hops"); n != 4 {
+		t.Errorf("剩余%d跳traceroute数据，want 4", n)
+	}
+}
+
+// 测速结果不保存在SQLite中时不保存吞吐量采样，也不会为此创建SQLite数据库
+func TestResultDetailsRequireSQLite(t *testing.T) {
+	previousPath := DBPath
+	DBPath = filepath.Join(t.TempDir(), "results.db")
+	defer func() { DBPath = previousPath }()
+
+	s, err := newJSONLStore(filepath.Join(t.TempDir(), "results.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := store
+	store = s
+	defer func() { store = previous }()
+
+	if storeIsSQLite() {
+		t.Fatal("JSONL存储被识别为SQLite")
+	}
+	result := &MeasureResult{RunID: "run1", Key: "run1/1", ServerName: "s1", TestTime: time.Unix(testBaseTime, 0),
+		Samples: []ThroughputSample{{Phase: PhaseDownload, Seconds: 1, Mbps: 100}}}
+	if err := saveResult(result); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(DBPath); !os.IsNotExist(err) {
+		t.Errorf("保存测速结果时创建了SQLite数据库: %v", err)
+	}
+	if records, err := store.Query(ResultFilter{}); err != nil || len(records) != 1 {
+		t.Errorf("存储中的测速结果 = %d (%v), 期望 1", len(records), err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 下载测试使用的随机数据块，随机内容可避免链路压缩影响测速结果
+var garbageChunk = func() []byte {
+	b := make([]byte, 1<<20)
+	rand.Read(b)
+	return b
+}()
+
+// 持续写入size字节的随机数据
+func writeGarbage(w io.Writer, size int64) error {
+	for size > 0 {
+		n := int64(len(garbageChunk))
+		if size < n {
+			n = size
+		}
+		if _, err := w.Write(garbageChunk[:n]); err != nil {
+			return err
+		}
+		size -= n
+	}
+	return nil
+}
+
+// 延迟测试：speedtest-go通过反复请求latency.txt计算往返时延
+func latencyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, "test=test\n")
+}
+
+// 下载测试：响应 /speedtest/random{N}x{N}.jpg 请求，返回与Ookla服务器大小相近的随机数据
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/speedtest/")
+	var width, height int64
+	if _, err := fmt.Sscanf(name, "random%dx%d.jpg", &width, &height); err != nil || width <= 0 || height <= 0 || width > 8000 || height > 8000 {
+		http.NotFound(w, r)
+		return
+	}
+
+	size := width * height * 2
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	writeGarbage(w, size)
+}
+
+// 上传测试：读取并丢弃请求体
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, "size=%d", n)
+}
+
+// 启动测速服务器，提供与speedtest.net服务器相同的HTTP下载、上传和延迟测试接口
+func startTestServer(port string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/speedtest/latency.txt", latencyHandler)
+	mux.HandleFunc("/speedtest/upload.php", uploadHandler)
+	mux.HandleFunc("/speedtest/", downloadHandler)
+
+	log.Printf("测速服务器已启动，监听端口: %s\n", port)
+	log.Printf("其他实例可使用 -server-url http://<本机地址>:%s 进行测速\n", port)
+	log.Fatal(http.ListenAndServe(":"+port, mux))
+}
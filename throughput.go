@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 吞吐量采样间隔
+const throughputInterval = time.Second
+
+// 测速过程中的一个吞吐量采样点
+type ThroughputSample struct {
+	Phase   string  `json:"phase"`   // download 或 upload
+	Seconds float64 `json:"seconds"` // 距该阶段开始的秒数
+	Mbps    float64 `json:"mbps"`
+}
+
+// 按固定间隔读取累计传输字节数，计算每秒吞吐量
+type throughputSampler struct {
+	phase   string
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	samples []ThroughputSample
+}
+
+// 启动吞吐量采样，total返回该阶段已传输的总字节数
+func startThroughputSampler(phase string, total func() int64) *throughputSampler {
+	s := &throughputSampler{phase: phase, stop: make(chan struct{})}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(throughputInterval)
+		defer ticker.Stop()
+		start := time.Now()
+		last := total()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				current := total()
+				s.samples = append(s.samples, ThroughputSample{
+					Phase:   phase,
+					Seconds: time.Since(start).Seconds(),
+					Mbps:    float64(current-last) * 8 / throughputInterval.Seconds() / 1e6,
+				})
+				last = current
+			}
+		}
+	}()
+	return s
+}
+
+// 停止采样并返回所有采样点
+func (s *throughputSampler) Stop() []ThroughputSample {
+	close(s.stop)
+	s.wg.Wait()
+	return s.samples
+}
+
+// 保存一次测速的吞吐量采样，按测速结果的唯一标识关联；result_id为存储分配的记录ID，仅供参考
+func saveThroughputSamples(tx *sql.Tx, result *MeasureResult, samples []ThroughputSample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	stmt, err := tx.Prepare("INSERT INTO speedtest_samples (result_id, result_key, phase, seconds, speed) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("插入吞吐量采样失败: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, sample := range samples {
+		if _, err := stmt.Exec(result.ID, result.Key, sample.Phase, sample.Seconds, sample.Mbps); err != nil {
+			return fmt.Errorf("插入吞吐量采样失败: %v", err)
+		}
+	}
+	return nil
+}
+
+// 查询测速结果的吞吐量采样，key为测速结果的唯一标识
+func querySamples(db *sql.DB, key string) (download, upload []ThroughputSample, err error) {
+	rows, err := db.Query("SELECT phase, seconds, speed FROM speedtest_samples WHERE result_key = ? ORDER BY phase, seconds", key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("查询吞吐量采样失败: %v", err)
+	}
+	defer rows.Close()
+
+	download = []ThroughputSample{}
+	upload = []ThroughputSample{}
+	for rows.Next() {
+		var sample ThroughputSample
+		if err := rows.Scan(&sample.Phase, &sample.Seconds, &sample.Mbps); err != nil {
+			return nil, nil, fmt.Errorf("扫描数据失败: %v", err)
+		}
+		if sample.Phase == PhaseDownload {
+			download = append(download, sample)
+		} else {
+			upload = append(upload, sample)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("遍历结果失败: %v", err)
+	}
+	return download, upload, nil
+}
+
+// 获取单次测速的吞吐量曲线
+func samplesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "无效的测速记录ID", http.StatusBadRequest)
+		return
+	}
+
+	// 测速结果不保存在SQLite中时没有吞吐量采样
+	download := []ThroughputSample{}
+	upload := []ThroughputSample{}
+	if storeIsSQLite() {
+		key, err := lookupResultKey(id)
+		if err != nil {
+			log.Printf("%v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		db, err := openDatabase()
+		if err != nil {
+			log.Printf("%v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer db.Close()
+
+		if download, upload, err = querySamples(db, key); err != nil {
+			log.Printf("%v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":       id,
+		"download": download,
+		"upload":   upload,
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"time"
+	_ "time/tzdata" // Windows等没有时区数据库的系统也能使用IANA时区名称
+)
+
+// 数据库中的时间保存为UTC Unix时间戳（秒），显示时转换到该时区：
+// 命令行输出、接口返回的时间和流量预算的计费周期使用该时区，Web界面按浏览器所在时区显示
+var displayLocation = time.Local
+
+// 早期版本按系统时区保存本地时间字符串，迁移5按该时区将其转换为时间戳，应为写入这些记录时的系统时区，
+// 默认为当前的系统时区
+var legacyLocation = time.Local
+
+// 设置显示时区，如 Asia/Shanghai、UTC，为空时使用系统时区
+func setDisplayTimeZone(name string) error {
+	loc, err := loadTimeZone(name)
+	if err != nil {
+		return err
+	}
+	displayLocation = loc
+	return nil
+}
+
+// 设置旧记录的时区，为空时使用系统时区
+func setLegacyTimeZone(name string) error {
+	loc, err := loadTimeZone(name)
+	if err != nil {
+		return err
+	}
+	legacyLocation = loc
+	return nil
+}
+
+// 按IANA名称加载时区，为空时返回系统时区
+func loadTimeZone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("无效的时区%s: %v", name, err)
+	}
+	return loc, nil
+}
+
+// 时区的名称和当前的UTC偏移，如"Local (+08:00)"，用于日志
+func describeLocation(loc *time.Location) string {
+	return fmt.Sprintf("%s (%s)", loc, time.Now().In(loc).Format("-07:00"))
+}
+
+// 解析旧版本保存的"2006-01-02 15:04:05"格式的本地时间，也接受RFC 3339时间。
+// 夏令时结束时重复的一小时内的时间对应两个时刻，无法区分，固定取较早的一个（夏令时）
+func parseLegacyTime(value string, loc *time.Location) (time.Time, error) {
+	const layout = "2006-01-02 15:04:05"
+	t, err := time.ParseInLocation(layout, value, loc)
+	if err != nil {
+		return time.Parse(time.RFC3339, value)
+	}
+
+	// 用前后半天的UTC偏移分别换算，换算结果的本地时间与原值相同的都是有效的时刻
+	wall, _ := time.Parse(layout, value)
+	for _, probe := range []time.Time{t.Add(-12 * time.Hour), t.Add(12 * time.Hour)} {
+		_, offset := probe.In(loc).Zone()
+		candidate := wall.Add(-time.Duration(offset) * time.Second)
+		if candidate.Before(t) && candidate.In(loc).Format(layout) == wall.Format(layout) {
+			t = candidate
+		}
+	}
+	return t.In(loc), nil
+}
+
+// 将Unix时间戳格式化为显示时区的"2006-01-02 15:04:05"，用于命令行输出
+func formatLocalTime(ts int64) string {
+	return time.Unix(ts, 0).In(displayLocation).Format("2006-01-02 15:04:05")
+}
+
+// 将Unix时间戳格式化为带时区偏移的RFC 3339时间，用于接口返回，浏览器按所在时区显示
+func formatAPITime(ts int64) string {
+	return time.Unix(ts, 0).In(displayLocation).Format(time.RFC3339)
+}
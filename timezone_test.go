@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLegacyTime(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		loc   *time.Location
+		want  string // UTC
+	}{
+		{"无夏令时", "2024-05-01 08:30:00", shanghai, "2024-05-01T00:30:00Z"},
+		{"夏令时", "2023-07-01 12:00:00", newYork, "2023-07-01T16:00:00Z"},
+		{"标准时间", "2023-12-01 12:00:00", newYork, "2023-12-01T17:00:00Z"},
+		// 2023-11-05 02:00 EDT回拨到01:00 EST，01:30出现两次，取较早的01:30 EDT
+		{"夏令时结束时重复的时间", "2023-11-05 01:30:00", newYork, "2023-11-05T05:30:00Z"},
+		{"夏令时结束前", "2023-11-05 00:59:59", newYork, "2023-11-05T04:59:59Z"},
+		{"夏令时结束后", "2023-11-05 02:00:00", newYork, "2023-11-05T07:00:00Z"},
+		{"RFC 3339时间", "2024-05-01T08:30:00+08:00", newYork, "2024-05-01T00:30:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLegacyTime(tt.value, tt.loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := got.UTC().Format(time.RFC3339); s != tt.want {
+				t.Errorf("parseLegacyTime(%q) = %s, want %s", tt.value, s, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseLegacyTime("2024/05/01", shanghai); err == nil {
+		t.Error("无法解析的时间应返回错误")
+	}
+}
+
+// 迁移时按指定的时区而不是系统时区转换旧记录
+func TestConvertLocalTimesUsesLegacyLocation(t *testing.T) {
+	db := openTestDatabase(t)
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := legacyLocation
+	legacyLocation = newYork
+	defer func() { legacyLocation = previous }()
+
+	if _, err := db.Exec("CREATE TABLE legacy (id INTEGER PRIMARY KEY, test_time)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO legacy (id, test_time) VALUES (1, '2023-11-05 01:30:00'), (2, 1700000000)"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := convertLocalTimes(tx, "legacy", "test_time"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int64]int64{
+		1: time.Date(2023, 11, 5, 5, 30, 0, 0, time.UTC).Unix(),
+		2: 1700000000, // 已经是时间戳的值不变
+	}
+	for id, ts := range want {
+		var got int64
+		if err := db.QueryRow("SELECT test_time FROM legacy WHERE id = ?", id).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != ts {
+			t.Errorf("记录%d: got %d, want %d", id, got, ts)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 判断基线时参考的最近成功测速次数
+const tracerouteBaselineCount = 20
+
+// traceroute的一跳，Addr为空表示该跳没有响应
+type TracerouteHop struct {
+	TTL  int
+	Addr string
+	RTT  time.Duration
+}
+
+// 一次traceroute的结果
+type TracerouteResult struct {
+	ResultID  int64
+	ResultKey string // 测速结果的唯一标识，见MeasureResult.Key
+	Target    string // host:port
+	Protocol  string
+	Reason    string // 触发traceroute的原因
+	Hops      []TracerouteHop
+	Reached   bool // 是否到达目标
+	Err       error
+	TestTime  time.Time
+}
+
+// 检查测速结果是否低于配置的阈值，返回触发原因，未触发时返回空字符串
+func degradedReason(result *MeasureResult, cfg TracerouteConfig) (string, error) {
+	if result.Err != nil {
+		// 被取消的测速不是网络问题，开始测速前就失败时也没有目标服务器
+		if !cfg.OnFailure || result.Status == StatusCanceled || result.ServerHost == "" {
+			return "", nil
+		}
+		return fmt.Sprintf("测速失败(%s): %v", result.Status, result.Err), nil
+	}
+
+	// 测速模式不包括的方向不比较速度
+	download, upload := modeIncludes(result.Mode, PhaseDownload), modeIncludes(result.Mode, PhaseUpload)
+	var reasons []string
+	if download && cfg.MinDownload > 0 && result.DownloadMbps < cfg.MinDownload {
+		reasons = append(reasons, fmt.Sprintf("下载速度%.2f Mbps低于%.2f Mbps", result.DownloadMbps, cfg.MinDownload))
+	}
+	if upload && cfg.MinUpload > 0 && result.UploadMbps < cfg.MinUpload {
+		reasons = append(reasons, fmt.Sprintf("上传速度%.2f Mbps低于%.2f Mbps", result.UploadMbps, cfg.MinUpload))
+	}
+	if cfg.MaxLatency > 0 && durationMs(result.Latency) > cfg.MaxLatency {
+		reasons = append(reasons, fmt.Sprintf("延迟%d ms高于%.0f ms", result.Latency.Milliseconds(), cfg.MaxLatency))
+	}
+	if cfg.MaxPacketLoss > 0 && result.PacketLoss > cfg.MaxPacketLoss {
+		reasons = append(reasons, fmt.Sprintf("丢包率%.1f%%高于%.1f%%", result.PacketLoss, cfg.MaxPacketLoss))
+	}
+	// 基线比例默认为0.5，设置为负数时不与基线比较
+	ratio := cfg.BaselineRatio
+	if ratio == 0 {
+		ratio = 0.5
+	}
+	if ratio > 0 {
+		baselineDownload, baselineUpload, err := serverBaseline(result)
+		if err != nil {
+			return "", err
+		}
+		if download && baselineDownload > 0 && result.DownloadMbps < baselineDownload*ratio {
+			reasons = append(reasons, fmt.Sprintf("下载速度%.2f Mbps低于基线%.2f Mbps的%.0f%%", result.DownloadMbps, baselineDownload, ratio*100))
+		}
+		if upload && baselineUpload > 0 && result.UploadMbps < baselineUpload*ratio {
+			reasons = append(reasons, fmt.Sprintf("上传速度%.2f Mbps低于基线%.2f Mbps的%.0f%%", result.UploadMbps, baselineUpload, ratio*100))
+		}
+	}
+	return strings.Join(reasons, "；"), nil
+}
+
+// 该服务器最近若干次使用相同测速参数的成功测速（不含本次）的下载和上传速度中位数，没有历史记录时为0
+func serverBaseline(result *MeasureResult) (float64, float64, error) {
+	// 参数不同的测速结果不可比较，旧记录没有测速参数，不作为基线。多取一条以便排除本次测速
+	records, err := store.Query(ResultFilter{
+		ServerName:  result.ServerName,
+		Status:      StatusOK,
+		Mode:        result.Mode,
+		Duration:    result.Duration.Seconds(),
+		Connections: result.Connections,
+		Limit:       tracerouteBaselineCount + 1,
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("查询基线数据失败: %v", err)
+	}
+
+	var downloads, uploads []float64
+	used := 0
+	for _, record := range records {
+		if record.ID == result.ID || used == tracerouteBaselineCount {
+			continue
+		}
+		used++
+		if record.DownloadSpeed != nil {
+			downloads = append(downloads, *record.DownloadSpeed)
+		}
+		if record.UploadSpeed != nil {
+			uploads = append(uploads, *record.UploadSpeed)
+		}
+	}
+	return medianFloat(downloads), medianFloat(uploads), nil
+}
+
+// 测速结果低于阈值时traceroute到测速服务器并保存，仅记录日志不影响测速结果
+// source为测速使用的出口，traceroute从同一出口发出
+func traceDegradedResult(ctx context.Context, result *MeasureResult, source string, cfg TracerouteConfig) {
+	reason, err := degradedReason(result, cfg)
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+	if reason == "" || ctx.Err() != nil {
+		return
+	}
+
+	log.Printf("服务器 %s 的测速结果异常（%s），正在traceroute到 %s", result.ServerName, reason, result.ServerHost)
+	trace := runTraceroute(ctx, result.ServerHost, result.Family, source, cfg)
+	trace.ResultID = result.ID
+	trace.ResultKey = result.Key
+	trace.Reason = reason
+	if trace.Err != nil {
+		log.Printf("traceroute失败: %v", trace.Err)
+	}
+	if err := saveTraceroute(trace); err != nil {
+		log.Printf("%v", err)
+	}
+}
+
+// 逐跳增加TTL探测到目标的路径，到达目标、超过最大跳数或ctx结束时停止
+// family和source不为空时只traceroute该地址族的地址并从该出口发出，与测速一致
+func runTraceroute(ctx context.Context, target, family, source string, cfg TracerouteConfig) *TracerouteResult {
+	protocol := cfg.Protocol
+	if protocol == "" {
+		protocol = "udp"
+	}
+	maxHops := cfg.MaxHops
+	if maxHops <= 0 {
+		maxHops = 30
+	}
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	trace := &TracerouteResult{Target: target, Protocol: protocol, TestTime: time.Now()}
+	if protocol != "udp" && protocol != "tcp" {
+		trace.Err = fmt.Errorf("不支持的traceroute协议%s，仅支持udp和tcp", protocol)
+		return trace
+	}
+
+	host, portStr := splitHostPort(target, "80")
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		trace.Err = fmt.Errorf("无效的端口: %s", portStr)
+		return trace
+	}
+	addrs, err := net.DefaultResolver.LookupIP(ctx, familyNetwork("ip", family), host)
+	if err != nil {
+		trace.Err = fmt.Errorf("解析%s失败: %v", host, err)
+		return trace
+	}
+	dst := addrs[0]
+	src, err := parseSource(source)
+	if err != nil {
+		trace.Err = err
+		return trace
+	}
+
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		// UDP和传统traceroute一样使用33434起的高端口，TCP使用测速服务器的端口，与测速流量走相同的路径
+		dstPort := port
+		if protocol == "udp" {
+			dstPort = 33433 + ttl
+		}
+
+		hopCtx, cancel := context.WithTimeout(ctx, timeout)
+		hop, final, rtt, err := traceHop(hopCtx, protocol, src, dst, dstPort, ttl)
+		cancel()
+		if ctx.Err() != nil {
+			trace.Err = fmt.Errorf("traceroute已取消: %w", ctx.Err())
+			return trace
+		}
+		if err != nil {
+			trace.Err = err
+			return trace
+		}
+
+		h := TracerouteHop{TTL: ttl, RTT: rtt}
+		if hop != nil {
+			h.Addr = hop.String()
+		}
+		trace.Hops = append(trace.Hops, h)
+		if final {
+			trace.Reached = hop != nil && hop.Equal(dst)
+			break
+		}
+	}
+	return trace
+}
+
+// 保存traceroute结果及每一跳
+func saveTraceroute(trace *TracerouteResult) error {
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("开始事务失败: %v", err)
+	}
+	defer tx.Rollback()
+
+	var errorMessage string
+	if trace.Err != nil {
+		errorMessage = trace.Err.Error()
+	}
+	res, err := tx.Exec("INSERT INTO traceroutes (result_id, result_key, target, protocol, reason, reached, error_message, test_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		trace.ResultID, trace.ResultKey, trace.Target, trace.Protocol, trace.Reason, trace.Reached, nullableString(errorMessage), trace.TestTime.Unix())
+	if err != nil {
+		return fmt.Errorf("插入traceroute记录失败: %v", err)
+	}
+	traceID, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("获取记录ID失败: %v", err)
+	}
+
+	for _, hop := range trace.Hops {
+		_, err := tx.Exec("INSERT INTO traceroute_hops (traceroute_id, ttl, address, rtt) VALUES (?, ?, ?, ?)",
+			traceID, hop.TTL, nullableString(hop.Addr), nullableMs(hop.RTT))
+		if err != nil {
+			return fmt.Errorf("插入traceroute数据失败: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("提交事务失败: %v", err)
+	}
+	return nil
+}
+
+// 查询测速结果关联的traceroute及每一跳，key为测速结果的唯一标识
+func queryTraceroutes(db *sql.DB, key string) ([]map[string]interface{}, error) {
+	rows, err := db.Query("SELECT id, target, protocol, reason, reached, error_message, test_time FROM traceroutes WHERE result_key = ? ORDER BY id", key)
+	if err != nil {
+		return nil, fmt.Errorf("查询traceroute记录失败: %v", err)
+	}
+	defer rows.Close()
+
+	traces := []map[string]interface{}{}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var target, protocol, reason string
+		var testTime int64
+		var reached bool
+		var errorMessage sql.NullString
+		if err := rows.Scan(&id, &target, &protocol, &reason, &reached, &errorMessage, &testTime); err != nil {
+			return nil, fmt.Errorf("扫描数据失败: %v", err)
+		}
+		ids = append(ids, id)
+		traces = append(traces, map[string]interface{}{
+			"target":        target,
+			"protocol":      protocol,
+			"reason":        reason,
+			"reached":       reached,
+			"error_message": nullString(errorMessage),
+			"test_time":     formatAPITime(testTime),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("遍历结果失败: %v", err)
+	}
+
+	for i, id := range ids {
+		hopRows, err := db.Query("SELECT ttl, address, rtt FROM traceroute_hops WHERE traceroute_id = ? ORDER BY ttl", id)
+		if err != nil {
+			return nil, fmt.Errorf("查询traceroute数据失败: %v", err)
+		}
+		hops := []map[string]interface{}{}
+		for hopRows.Next() {
+			var ttl int
+			var address sql.NullString
+			var rtt sql.NullFloat64
+			if err := hopRows.Scan(&ttl, &address, &rtt); err != nil {
+				hopRows.Close()
+				return nil, fmt.Errorf("扫描数据失败: %v", err)
+			}
+			hops = append(hops, map[string]interface{}{
+				"ttl":     ttl,
+				"address": nullString(address),
+				"rtt":     nullFloat(rtt),
+			})
+		}
+		hopRows.Close()
+		traces[i]["hops"] = hops
+	}
+	return traces, nil
+}
+
+// 获取单次测速的详细结果，包括吞吐量采样和traceroute
+func resultDetailHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "无效的记录ID", http.StatusBadRequest)
+		return
+	}
+
+	records, err := store.Query(ResultFilter{ID: id})
+	if err != nil {
+		log.Printf("%v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if len(records) == 0 {
+		http.Error(w, "记录不存在", http.StatusNotFound)
+		return
+	}
+	record := records[0]
+
+	// 测速结果不保存在SQLite中时没有traceroute记录
+	traces := []map[string]interface{}{}
+	if storeIsSQLite() {
+		db, err := openDatabase()
+		if err != nil {
+			log.Printf("%v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer db.Close()
+		if traces, err = queryTraceroutes(db, stringValue(record.Key)); err != nil {
+			log.Printf("%v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":                id,
+		"backend":           record.Backend,
+		"ip_family":         record.Family,
+		"interface":         record.Interface,
+		"isp":               record.ISP,
+		"server_name":       record.ServerName,
+		"server_country":    record.ServerCountry,
+		"server_distance":   record.ServerDistance,
+		"server_id":         record.ServerID,
+		"server_host":       record.ServerHost,
+		"server_sponsor":    record.ServerSponsor,
+		"server_lat":        record.ServerLat,
+		"server_lon":        record.ServerLon,
+		"public_ip":         record.PublicIP,
+		"client_version":    record.ClientVersion,
+		"backend_version":   record.BackendVersion,
+		"latency":           record.Latency,
+		"jitter":            record.Jitter,
+		"latency_min":       record.LatencyMin,
+		"latency_median":    record.LatencyMedian,
+		"latency_max":       record.LatencyMax,
+		"packet_loss":       record.PacketLoss,
+		"latency_download":  record.LatencyDownload,
+		"latency_upload":    record.LatencyUpload,
+		"bufferbloat_grade": record.BufferbloatGrade,
+		"download_speed":    record.DownloadSpeed,
+		"upload_speed":      record.UploadSpeed,
+		"params":            record.params(),
+		"bytes_used":        record.BytesUsed,
+		"status":            record.Status,
+		"failed_phase":      record.FailedPhase,
+		"error_message":     record.ErrorMessage,
+		"test_time":         formatAPITime(record.TestTime),
+		"traceroutes":       traces,
+	})
+}
+
+// 单次测速详情页面，数据通过/api/result获取
+func resultPageHandler(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := template.ParseFS(templatesFS, "templates/result.html")
+	if err != nil {
+		log.Printf("解析模板失败: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, nil)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// sock_extended_err中的ee_origin，syscall包未定义
+const (
+	soEEOriginLocal = 1
+	soEEOriginICMP  = 2
+	soEEOriginICMP6 = 3
+)
+
+// 一个探测的响应，addr为nil表示只知道该跳有响应但无法得知地址
+type hopReply struct {
+	addr  net.IP
+	final bool // 已到达目标或路径不可达，不需要继续增加TTL
+}
+
+// 从source（为nil时由系统路由决定）发送一个TTL为ttl的探测，返回响应的地址（无响应时为nil）、是否应停止以及往返时间
+//
+// 不需要root权限：设置IP_RECVERR后，内核会把路由器返回的ICMP超时/不可达消息
+// 放入套接字的错误队列，从中可以读出发送ICMP消息的地址。
+// UDP探测在到达目标时收到端口不可达；TCP探测在到达目标时连接成功或被拒绝。
+func traceHop(ctx context.Context, protocol string, source *sourceAddr, dst net.IP, port, ttl int) (net.IP, bool, time.Duration, error) {
+	family, level, ttlOpt, recvErrOpt := syscall.AF_INET, syscall.IPPROTO_IP, syscall.IP_TTL, syscall.IP_RECVERR
+	var sa syscall.Sockaddr
+	if ip4 := dst.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		family, level, ttlOpt, recvErrOpt = syscall.AF_INET6, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, syscall.IPV6_RECVERR
+		sa6 := &syscall.SockaddrInet6{Port: port}
+		copy(sa6.Addr[:], dst.To16())
+		sa = sa6
+	}
+	sotype := syscall.SOCK_DGRAM
+	if protocol == "tcp" {
+		sotype = syscall.SOCK_STREAM
+	}
+
+	fd, err := syscall.Socket(family, sotype|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, false, 0, fmt.Errorf("创建套接字失败: %v", err)
+	}
+	// 非阻塞的文件描述符由运行时的网络轮询器管理，可以设置超时
+	file := os.NewFile(uintptr(fd), "traceroute")
+	defer file.Close()
+	if err := syscall.SetsockoptInt(fd, level, ttlOpt, ttl); err != nil {
+		return nil, false, 0, fmt.Errorf("设置TTL失败: %v", err)
+	}
+	if err := syscall.SetsockoptInt(fd, level, recvErrOpt, 1); err != nil {
+		return nil, false, 0, fmt.Errorf("设置IP_RECVERR失败: %v", err)
+	}
+	if source != nil {
+		ip := source.ip(familyOf(dst))
+		if ip == nil {
+			return nil, false, 0, fmt.Errorf("%s没有%s地址", source.name, familyName(familyOf(dst)))
+		}
+		if err := source.bind(uintptr(fd), ip); err != nil {
+			return nil, false, 0, err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		file.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { file.SetDeadline(time.Now()) })
+	defer stop()
+
+	start := time.Now()
+	if protocol == "tcp" {
+		err = syscall.Connect(fd, sa)
+		if err == syscall.ECONNREFUSED {
+			return dst, true, time.Since(start), nil
+		}
+		if err != nil && err != syscall.EINPROGRESS {
+			return nil, false, 0, fmt.Errorf("发送探测失败: %v", err)
+		}
+	} else if err := syscall.Sendto(fd, []byte("speedtest-traceroute"), 0, sa); err != nil {
+		return nil, false, 0, fmt.Errorf("发送探测失败: %v", err)
+	}
+
+	raw, err := file.SyscallConn()
+	if err != nil {
+		return nil, false, 0, err
+	}
+	// 错误队列有数据时套接字同时变为可读和可写；TCP连接建立时变为可写
+	wait := raw.Read
+	if protocol == "tcp" {
+		wait = raw.Write
+	}
+	var reply *hopReply
+	var hopErr error
+	err = wait(func(fd uintptr) bool {
+		reply, hopErr = readHop(int(fd), protocol, dst)
+		return reply != nil || hopErr != nil
+	})
+	rtt := time.Since(start)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		// 该跳没有响应
+		return nil, false, 0, nil
+	}
+	if err != nil {
+		return nil, false, 0, err
+	}
+	if hopErr != nil {
+		return nil, false, 0, hopErr
+	}
+	return reply.addr, reply.final, rtt, nil
+}
+
+// 读取错误队列中的ICMP消息，TCP还要检查连接是否已建立，尚无结果时返回nil
+func readHop(fd int, protocol string, dst net.IP) (*hopReply, error) {
+	buf := make([]byte, 512)
+	oob := make([]byte, 512)
+	_, oobn, _, _, err := syscall.Recvmsg(fd, buf, oob, syscall.MSG_ERRQUEUE)
+	if err == nil {
+		return parseHopError(oob[:oobn])
+	}
+	if err != syscall.EAGAIN {
+		return nil, fmt.Errorf("读取ICMP消息失败: %v", err)
+	}
+
+	if protocol == "tcp" {
+		soErr, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ERROR)
+		if err != nil {
+			return nil, fmt.Errorf("读取连接状态失败: %v", err)
+		}
+		switch syscall.Errno(soErr) {
+		case 0:
+			if _, err := syscall.Getpeername(fd); err == nil {
+				return &hopReply{addr: dst, final: true}, nil
+			}
+		case syscall.ECONNREFUSED:
+			return &hopReply{addr: dst, final: true}, nil
+		case syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+			// 内核把ICMP超时转换成了连接错误而没有放入错误队列，只知道该跳有响应
+			return &hopReply{}, nil
+		default:
+			return nil, fmt.Errorf("连接失败: %v", syscall.Errno(soErr))
+		}
+	}
+	return nil, nil
+}
+
+// 解析IP_RECVERR控制消息：struct sock_extended_err之后紧跟发送ICMP消息的地址
+func parseHopError(oob []byte) (*hopReply, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("解析ICMP消息失败: %v", err)
+	}
+	for _, msg := range msgs {
+		isV4 := msg.Header.Level == syscall.IPPROTO_IP && msg.Header.Type == syscall.IP_RECVERR
+		isV6 := msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == syscall.IPV6_RECVERR
+		if (!isV4 && !isV6) || len(msg.Data) < 16 {
+			continue
+		}
+
+		errno := binary.NativeEndian.Uint32(msg.Data[0:])
+		origin, icmpType := msg.Data[4], msg.Data[5]
+		if origin == soEEOriginLocal {
+			return nil, fmt.Errorf("发送探测失败: %v", syscall.Errno(errno))
+		}
+		if origin != soEEOriginICMP && origin != soEEOriginICMP6 {
+			continue
+		}
+		// 超时消息（ICMP类型11，ICMPv6类型3）来自中间路由器，可以继续增加TTL；
+		// 其余为不可达消息，来自目标（端口不可达）或无法继续转发的路由器
+		timeExceeded := (origin == soEEOriginICMP && icmpType == 11) || (origin == soEEOriginICMP6 && icmpType == 3)
+
+		offender := msg.Data[16:]
+		var hop net.IP
+		switch {
+		case len(offender) >= 8 && binary.NativeEndian.Uint16(offender) == syscall.AF_INET:
+			hop = net.IP(append([]byte(nil), offender[4:8]...))
+		case len(offender) >= 24 && binary.NativeEndian.Uint16(offender) == syscall.AF_INET6:
+			hop = net.IP(append([]byte(nil), offender[8:24]...))
+		default:
+			continue
+		}
+		return &hopReply{addr: hop, final: !timeExceeded}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// 非特权traceroute依赖Linux的IP_RECVERR，其他系统暂不支持
+func traceHop(ctx context.Context, protocol string, source *sourceAddr, dst net.IP, port, ttl int) (net.IP, bool, time.Duration, error) {
+	return nil, false, 0, fmt.Errorf("当前系统不支持traceroute")
+}
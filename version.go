@@ -0,0 +1,43 @@
+package main
+
+import (
+	"runtime/debug"
+)
+
+// 程序版本，发布时通过 -ldflags "-X main.appVersion=v1.2.0" 设置
+var appVersion = ""
+
+// 返回程序版本，保存到每条测速结果中；未通过ldflags设置时使用构建信息中的模块版本，
+// 本地构建时为VCS修订号（有未提交的修改时加上-dirty），都没有时为"dev"
+func programVersion() string {
+	if appVersion != "" {
+		return appVersion
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	var revision string
+	var modified bool
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "dev"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
@@ -6,14 +6,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
-	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
-	"github.com/showwin/speedtest-go/speedtest"
 )
 
 //go:embed templates/*
@@ -40,6 +39,36 @@ func reverseIntSlice(s []int) {
 	}
 }
 
+// 反转int64切片
+func reverseInt64Slice(s []int64) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
+
+// 反转interface切片
+func reverseInterfaceSlice(s []interface{}) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
+
+// 将可能为NULL的数值转换为JSON值，NULL对应null
+func nullFloat(v sql.NullFloat64) interface{} {
+	if !v.Valid {
+		return nil
+	}
+	return v.Float64
+}
+
+// 将可能为NULL的字符串转换为JSON值，NULL对应null
+func nullString(v sql.NullString) interface{} {
+	if !v.Valid {
+		return nil
+	}
+	return v.String
+}
+
 // GetIndexTemplate 从嵌入式文件系统加载并解析index.html模板
 func GetIndexTemplate() (*template.Template, error) {
 	return template.ParseFS(templatesFS, "templates/index.html")
@@ -58,8 +87,71 @@ type TestResult struct {
 	DownloadSpeed float64 `json:"download_speed"`
 	UploadSpeed   float64 `json:"upload_speed"`
 	Latency       int     `json:"latency"`
-	ISP           string  `json:"isp"`
-	ServerName    string  `json:"server_name"`
+	Jitter        float64 `json:"jitter"`
+	PacketLoss    float64 `json:"packet_loss"` // -1表示不支持
+	// 负载延迟(ms)和缓冲膨胀等级，未启用负载延迟测量时为空
+	LatencyDownload  float64 `json:"latency_download,omitempty"`
+	LatencyUpload    float64 `json:"latency_upload,omitempty"`
+	BufferbloatGrade string  `json:"bufferbloat_grade,omitempty"`
+	ISP              string  `json:"isp"`
+	ServerName       string  `json:"server_name"`
+	Family           string  `json:"ip_family,omitempty"` // 地址族：v4、v6
+	// 测速参数，测速模式不包括下载或上传时对应的速度为0
+	Mode        string  `json:"test_mode"`
+	Duration    float64 `json:"test_duration"` // 秒
+	Connections int     `json:"connections"`
+	Params      string  `json:"params"` // 测速参数的描述，如"完整 15s×4"
+}
+
+// 一轮测速的返回结果：速度和延迟为第一个地址族各服务器的中位数，Families为每个地址族的汇总，Servers为每个服务器的结果
+type RunTestResult struct {
+	TestResult
+	RunID        string            `json:"run_id"`
+	DownloadBest float64           `json:"download_best"`
+	UploadBest   float64           `json:"upload_best"`
+	LatencyBest  int               `json:"latency_best"`
+	Families     []RunFamilyResult `json:"families"`
+	Servers      []TestResult      `json:"servers"`
+}
+
+// 一轮测速中一个地址族的汇总
+type RunFamilyResult struct {
+	Family         string  `json:"ip_family"`
+	Count          int     `json:"count"`
+	DownloadMedian float64 `json:"download_median"`
+	DownloadBest   float64 `json:"download_best"`
+	UploadMedian   float64 `json:"upload_median"`
+	UploadBest     float64 `json:"upload_best"`
+	LatencyMedian  int     `json:"latency_median"`
+	LatencyBest    int     `json:"latency_best"`
+}
+
+// 将单个服务器的测速结果转换为接口返回格式
+func newTestResult(measured *MeasureResult) TestResult {
+	return TestResult{
+		DownloadSpeed:    measured.DownloadMbps,
+		UploadSpeed:      measured.UploadMbps,
+		Latency:          int(measured.Latency.Milliseconds()),
+		Jitter:           durationMs(measured.Jitter),
+		PacketLoss:       measured.PacketLoss,
+		LatencyDownload:  durationMs(measured.LatencyDownload),
+		LatencyUpload:    durationMs(measured.LatencyUpload),
+		BufferbloatGrade: measured.BufferbloatGrade,
+		ISP:              measured.ISP,
+		ServerName:       measured.ServerName,
+		Family:           measured.Family,
+		Mode:             measured.Mode,
+		Duration:         measured.Duration.Seconds(),
+		Connections:      measured.Connections,
+		Params:           formatTestParams(measured.Mode, measured.Duration.Seconds(), int64(measured.Connections)),
+	}
+}
+
+// 手动测速请求的JSON请求体，均为可选，未指定的参数使用配置文件或命令行的设置
+type runTestRequest struct {
+	Mode        string `json:"mode"`        // full、ping、download、upload
+	Duration    int    `json:"duration"`    // 下载和上传各自的测试时长（秒）
+	Connections int    `json:"connections"` // 并发连接数
 }
 
 // 执行测速处理函数
@@ -68,80 +160,103 @@ func runTestHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-
-	// 1. 初始化客户端并获取服务器信息
-	user, err := speedtest.FetchUserInfo()
-	if err != nil {
-		log.Printf("获取用户信息失败: %v", err)
-		http.Error(w, "获取用户信息失败", http.StatusInternalServerError)
+	if storeReadOnly() {
+		http.Error(w, "测速结果存储为只读，不能测速", http.StatusForbidden)
 		return
 	}
 
-	// 获取全球Speedtest服务器列表
-	servers, err := speedtest.FetchServers()
-	if err != nil {
-		log.Printf("获取服务器列表失败: %v", err)
-		http.Error(w, "获取服务器列表失败", http.StatusInternalServerError)
-		return
+	// 指定了出口时通过该出口测速
+	opts := config.measureOptions()
+	if name := r.URL.Query().Get("uplink"); name != "" {
+		uplink, ok := config.findUplink(name)
+		if !ok {
+			http.Error(w, "未配置的出口: "+name, http.StatusBadRequest)
+			return
+		}
+		opts = config.uplinkOptions(uplink)
 	}
 
-	// 2. 筛选最优服务器
-	targets, err := servers.FindServer([]int{})
-	if err != nil {
-		log.Printf("筛选服务器失败: %v", err)
-		http.Error(w, "筛选服务器失败", http.StatusInternalServerError)
+	// 请求体可以指定本次测速的参数
+	var req runTestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "无效的请求体: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	server := targets[0]
-
-	// 3. 测试延迟
-	server.PingTest(func(latency time.Duration) {
-		// 回调函数为空
-	})
-
-	// 4. 测试下载速度
-	server.DownloadTest()
-	downloadMbps := float64(server.DLSpeed) * 8 / 1e6
-
-	// 5. 测试上传速度
-	server.UploadTest()
-	uploadMbps := float64(server.ULSpeed) * 8 / 1e6
-
-	// 6. 保存测试结果到数据库
-	db, err := openDatabase()
-	if err != nil {
-		log.Printf("%v", err)
-		http.Error(w, "保存结果失败", http.StatusInternalServerError)
+	if req.Mode != "" {
+		if _, err := parseMode(req.Mode); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.Mode = req.Mode
+	}
+	if req.Duration < 0 || req.Connections < 0 {
+		http.Error(w, "测试时长和并发连接数不能为负数", http.StatusBadRequest)
 		return
 	}
-	defer db.Close()
+	if req.Duration > 0 {
+		opts.Duration = time.Duration(req.Duration) * time.Second
+	}
+	if req.Connections > 0 {
+		opts.Connections = req.Connections
+	}
 
-	// 插入数据
-	testTime := time.Now().Format("2006-01-02 15:04:05")
-	insertSQL := `
-	INSERT INTO speedtest_results (isp, server_name, server_country, server_distance, latency, download_speed, upload_speed, test_time)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`
-	_, err = db.Exec(insertSQL, user.Isp, server.Name, server.Country, server.Distance, server.Latency.Milliseconds(), downloadMbps, uploadMbps, testTime)
+	// 执行测速并保存结果
+	// 客户端断开连接时同样取消测速
+	run, err := runTest(r.Context(), opts)
 	if err != nil {
-		log.Printf("插入数据失败: %v", err)
-		http.Error(w, "保存结果失败", http.StatusInternalServerError)
+		log.Printf("测速失败: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// 7. 返回测试结果
-	result := TestResult{
-		DownloadSpeed: downloadMbps,
-		UploadSpeed:   uploadMbps,
-		Latency:       int(server.Latency.Milliseconds()),
-		ISP:           user.Isp,
-		ServerName:    server.Name,
+	// 返回测试结果，其余指标取第一个测速成功的服务器的结果
+	first := run.Summaries[0]
+	result := RunTestResult{
+		TestResult:   newTestResult(run.Succeeded[0]),
+		RunID:        run.ID,
+		DownloadBest: first.DownloadBest,
+		UploadBest:   first.UploadBest,
+		LatencyBest:  int(first.LatencyBest.Milliseconds()),
+	}
+	result.DownloadSpeed = first.DownloadMedian
+	result.UploadSpeed = first.UploadMedian
+	result.Latency = int(first.LatencyMedian.Milliseconds())
+	for _, summary := range run.Summaries {
+		result.Families = append(result.Families, RunFamilyResult{
+			Family:         summary.Family,
+			Count:          len(summary.Succeeded),
+			DownloadMedian: summary.DownloadMedian,
+			DownloadBest:   summary.DownloadBest,
+			UploadMedian:   summary.UploadMedian,
+			UploadBest:     summary.UploadBest,
+			LatencyMedian:  int(summary.LatencyMedian.Milliseconds()),
+			LatencyBest:    int(summary.LatencyBest.Milliseconds()),
+		})
+	}
+	for _, measured := range run.Succeeded {
+		result.Servers = append(result.Servers, newTestResult(measured))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
 }
 
+// 取消正在进行的测速
+func cancelTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	canceled := cancelRunningTests()
+	log.Printf("已取消%d个正在进行的测速", canceled)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"canceled": canceled,
+	})
+}
+
 // 首页处理函数
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl, err := GetIndexTemplate()
@@ -151,85 +266,145 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl.Execute(w, nil)
 }
 
-// 获取图表数据的API，接受limit参数限制返回的记录数
+// 获取图表数据的API，接受limit参数限制返回的记录数，interface参数只返回指定出口的记录
 func chartDataHandler(limit int) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// 连接数据库
-		db, err := openDatabase()
+		// 按出口筛选，未指定出口的记录interface为NULL
+		records, err := store.Query(ResultFilter{Interface: r.URL.Query().Get("interface"), Limit: limit})
 		if err != nil {
 			log.Printf("%v", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
-		defer db.Close()
-
-		// 查询数据
-		// 使用strftime函数确保时间格式为'MM-DD HH:MM'
-		rows, err := db.Query("SELECT strftime('%m-%d %H:%M', test_time) as test_time, download_speed, upload_speed, latency FROM speedtest_results ORDER BY test_time DESC LIMIT ?", limit)
-		if err != nil {
-			log.Printf("查询数据失败: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
 
-		// 分离查询结果为三个独立的数组
-		var downloadData []float64
-		var uploadData []float64
-		var latencyData []int
-		var labels []string
-
-		for rows.Next() {
-			var testTime string
-			var downloadSpeed, uploadSpeed float64
-			var latency int
-
-			err := rows.Scan(&testTime, &downloadSpeed, &uploadSpeed, &latency)
-			if err != nil {
-				log.Printf("扫描数据失败: %v", err)
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-				return
+		// 分离查询结果为三个独立的数组，失败的测速对应位置返回null
+		var downloadData []interface{}
+		var uploadData []interface{}
+		var latencyData []interface{}
+		// 时间以RFC 3339格式返回，由浏览器按本地时区显示
+		var timestamps []string
+		var ids []int64
+		// 旧记录没有以下指标，对应位置返回null
+		var jitterData, latencyMinData, latencyMaxData, latencyMedianData, packetLossData []interface{}
+		var latencyDownloadData, latencyUploadData, bufferbloatData []interface{}
+		// 测速状态，失败时附带失败阶段和错误信息
+		var statusData []string
+		var failedPhaseData, errorData []interface{}
+		// 地址族（v4、v6），旧记录和无法得知时为null
+		var familyData []interface{}
+		// 测速参数的描述，参数不同的结果不应直接比较，旧记录为"-"
+		var paramsData []string
+		// 测速消耗的流量(字节)，旧记录为null
+		var bytesData []interface{}
+		// 测速时的公网IP，用于发现运营商更换了出口地址，旧记录为null
+		var publicIPData []interface{}
+
+		for _, record := range records {
+			ids = append(ids, record.ID)
+			timestamps = append(timestamps, formatAPITime(record.TestTime))
+			statusData = append(statusData, record.Status)
+			failedPhaseData = append(failedPhaseData, record.FailedPhase)
+			errorData = append(errorData, record.ErrorMessage)
+			familyData = append(familyData, record.Family)
+			paramsData = append(paramsData, record.params())
+			bytesData = append(bytesData, record.BytesUsed)
+			publicIPData = append(publicIPData, record.PublicIP)
+			if record.Status != StatusOK {
+				// 失败的测速没有有效的测量值
+				downloadData = append(downloadData, nil)
+				uploadData = append(uploadData, nil)
+				latencyData = append(latencyData, nil)
+				jitterData = append(jitterData, nil)
+				latencyMinData = append(latencyMinData, nil)
+				latencyMaxData = append(latencyMaxData, nil)
+				latencyMedianData = append(latencyMedianData, nil)
+				packetLossData = append(packetLossData, nil)
+				latencyDownloadData = append(latencyDownloadData, nil)
+				latencyUploadData = append(latencyUploadData, nil)
+				bufferbloatData = append(bufferbloatData, nil)
+				continue
 			}
-
-			labels = append(labels, testTime)
-			downloadData = append(downloadData, downloadSpeed)
-			uploadData = append(uploadData, uploadSpeed)
-			latencyData = append(latencyData, latency)
+			// 测速模式不包括的方向为null
+			downloadData = append(downloadData, record.DownloadSpeed)
+			uploadData = append(uploadData, record.UploadSpeed)
+			latencyData = append(latencyData, record.Latency)
+			jitterData = append(jitterData, record.Jitter)
+			latencyMinData = append(latencyMinData, record.LatencyMin)
+			latencyMaxData = append(latencyMaxData, record.LatencyMax)
+			latencyMedianData = append(latencyMedianData, record.LatencyMedian)
+			packetLossData = append(packetLossData, record.PacketLoss)
+			latencyDownloadData = append(latencyDownloadData, record.LatencyDownload)
+			latencyUploadData = append(latencyUploadData, record.LatencyUpload)
+			bufferbloatData = append(bufferbloatData, record.BufferbloatGrade)
 		}
 
 		// 返回JSON数据
 		w.Header().Set("Content-Type", "application/json")
 		// 反转数据，确保时间顺序从旧到新
-		reverseStringSlice(labels)
-		reverseFloat64Slice(downloadData)
-		reverseFloat64Slice(uploadData)
-		reverseIntSlice(latencyData)
+		reverseInt64Slice(ids)
+		reverseStringSlice(timestamps)
+		reverseInterfaceSlice(downloadData)
+		reverseInterfaceSlice(uploadData)
+		reverseInterfaceSlice(latencyData)
+		reverseInterfaceSlice(jitterData)
+		reverseInterfaceSlice(latencyMinData)
+		reverseInterfaceSlice(latencyMaxData)
+		reverseInterfaceSlice(latencyMedianData)
+		reverseInterfaceSlice(packetLossData)
+		reverseInterfaceSlice(latencyDownloadData)
+		reverseInterfaceSlice(latencyUploadData)
+		reverseInterfaceSlice(bufferbloatData)
+		reverseStringSlice(statusData)
+		reverseInterfaceSlice(failedPhaseData)
+		reverseInterfaceSlice(errorData)
+		reverseInterfaceSlice(familyData)
+		reverseStringSlice(paramsData)
+		reverseInterfaceSlice(bytesData)
+		reverseInterfaceSlice(publicIPData)
 
 		// 获取最近一次测试的运营商、服务器名称和距离信息
 		var isp, serverName string
 		var distance float64
 
 		// 查询最新的一条记录
-		err = db.QueryRow("SELECT isp, server_name, server_distance FROM speedtest_results ORDER BY test_time DESC LIMIT 1").Scan(&isp, &serverName, &distance)
-		if err != nil && err != sql.ErrNoRows {
+		latest, err := store.Query(ResultFilter{Status: StatusOK, Limit: 1})
+		if err != nil {
 			log.Printf("查询服务器信息失败: %v", err)
 			// 不中断程序，继续返回其他数据
+		} else if len(latest) > 0 {
+			isp, serverName, distance = latest[0].ISP, latest[0].ServerName, latest[0].ServerDistance
 		}
 
 		// 返回JSON数据
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"labels":       labels,
-			"downloadData": downloadData,
-			"uploadData":   uploadData,
-			"latencyData":  latencyData,
-			"isp":          isp,
-			"serverName":   serverName,
-			"distance":     distance,
+			"ids":                 ids,
+			"timestamps":          timestamps,
+			"downloadData":        downloadData,
+			"uploadData":          uploadData,
+			"latencyData":         latencyData,
+			"jitterData":          jitterData,
+			"latencyMinData":      latencyMinData,
+			"latencyMaxData":      latencyMaxData,
+			"latencyMedianData":   latencyMedianData,
+			"packetLossData":      packetLossData,
+			"latencyDownloadData": latencyDownloadData,
+			"latencyUploadData":   latencyUploadData,
+			"bufferbloatData":     bufferbloatData,
+			"statusData":          statusData,
+			"failedPhaseData":     failedPhaseData,
+			"errorData":           errorData,
+			"familyData":          familyData,
+			"paramsData":          paramsData,
+			"bytesData":           bytesData,
+			"publicIPData":        publicIPData,
+			"isp":                 isp,
+			"serverName":          serverName,
+			"distance":            distance,
 		})
 	}
 }
 
-// 初始化数据库
+// 初始化数据库，执行尚未执行的迁移，所有模式共用同一份表结构
 func initDatabase() error {
 	db, err := openDatabase()
 	if err != nil {
@@ -237,35 +412,44 @@ func initDatabase() error {
 	}
 	defer db.Close()
 
-	// 创建表
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS speedtest_results (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		isp TEXT,
-		server_name TEXT,
-		server_country TEXT,
-		server_distance REAL,
-		latency INTEGER,
-		download_speed REAL,
-		upload_speed REAL,
-		test_time TEXT
-	)
-	`
-	_, err = db.Exec(createTableSQL)
+	return migrateDatabase(db, func(m migration) {
+		log.Printf("数据库已升级到版本%d: %s", m.version, m.description)
+	})
+}
+
+// 检查表中是否存在指定列，不存在时通过ALTER TABLE添加
+func ensureColumn(db dbExecer, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
 	if err != nil {
-		return fmt.Errorf("创建表失败: %v", err)
+		return fmt.Errorf("查询表结构失败: %v", err)
 	}
+	defer rows.Close()
 
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("扫描表结构失败: %v", err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("遍历表结构失败: %v", err)
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("添加列%s失败: %v", column, err)
+	}
 	return nil
 }
 
 // 启动Web服务器
 func startWebServer(port string, limit int) {
-	// 初始化数据库
-	if err := initDatabase(); err != nil {
-		log.Fatalf("初始化数据库失败: %v", err)
-	}
-
 	// 创建templates目录
 	// 注意：在实际运行前需要手动创建templates目录并放置index.html文件
 
@@ -273,7 +457,26 @@ func startWebServer(port string, limit int) {
 	http.HandleFunc("/", indexHandler)
 	http.HandleFunc("/api/chart-data", chartDataHandler(limit))
 	http.HandleFunc("/api/run-test", runTestHandler)
+	http.HandleFunc("/api/cancel-test", cancelTestHandler)
 	http.HandleFunc("/api/ip-info", getIPInfoHandler)
+	http.HandleFunc("/api/samples", samplesHandler)
+	http.HandleFunc("/api/runs", runsHandler(limit))
+	http.HandleFunc("/api/server-stats", serverStatsHandler)
+	http.HandleFunc("/api/interfaces", interfacesHandler)
+	http.HandleFunc("/api/data-usage", dataUsageHandler)
+	http.HandleFunc("/api/outages", outagesHandler)
+	http.HandleFunc("/api/latency", latencyResultsHandler)
+	http.HandleFunc("/api/dns", dnsBenchHandler(limit))
+	http.HandleFunc("/api/http-probes", httpProbesHandler(limit))
+	http.HandleFunc("/api/result", resultDetailHandler)
+	http.HandleFunc("/result", resultPageHandler)
+
+	// 浏览器测速（访问者浏览器↔本机）
+	http.HandleFunc("/api/browser-test/garbage", browserGarbageHandler)
+	http.HandleFunc("/api/browser-test/empty", browserEmptyHandler)
+	http.HandleFunc("/api/browser-test/ping", browserPingHandler)
+	http.HandleFunc("/api/browser-test/result", browserResultHandler)
+	http.HandleFunc("/api/browser-chart-data", browserChartDataHandler(limit))
 
 	// 启动服务器
 	log.Printf("Web服务器已启动，监听端口: %s\n", port)
@@ -291,58 +494,62 @@ type IPDetail struct {
 
 type IPInfo struct {
     ServerIP    IPDetail `json:"server_ip"`
+    ServerIPv4  string   `json:"server_ipv4"` // 服务器的IPv4公网地址，没有IPv4网络时为空
+    ServerIPv6  string   `json:"server_ipv6"` // 服务器的IPv6公网地址，没有IPv6网络时为空
     VisitorIP   IPDetail `json:"visitor_ip"`
 }
 
 // 获取公网IP和地理位置信息的处理函数
 func getIPInfoHandler(w http.ResponseWriter, r *http.Request) {
 	// 获取访问者IP
-	visitorIP := r.RemoteAddr
-	log.Printf("原始访问者IP: %s\n", visitorIP)
-	// 移除端口部分
-	if idx := strings.LastIndex(visitorIP, ":"); idx != -1 {
-		visitorIP = visitorIP[:idx]
-		log.Printf("移除端口后的访问者IP: %s\n", visitorIP)
-	} else {
-		// 移除端口部分
-		if idx := strings.LastIndex(visitorIP, ":"); idx != -1 {
-			visitorIP = visitorIP[:idx]
+	visitorIP := clientIP(r)
+	log.Printf("访问者IP: %s\n", visitorIP)
+
+	// 指定了出口时获取该出口的公网IP
+	opts := config.measureOptions()
+	if name := r.URL.Query().Get("uplink"); name != "" {
+		uplink, ok := config.findUplink(name)
+		if !ok {
+			http.Error(w, "未配置的出口: "+name, http.StatusBadRequest)
+			return
 		}
+		opts = config.uplinkOptions(uplink)
 	}
 
-	// 获取服务器公网IP
-	serverIP := visitorIP
-	// 如果是本地测试，使用icanhazip.com的API获取公网IP
-	if visitorIP == "[::1]" || visitorIP == "127.0.0.1" || visitorIP == "localhost" {
-		// 创建带有超时设置的HTTP客户端
-		client := &http.Client{
-			Timeout: 5 * time.Second,
-		}
-
-		// 使用icanhazip.com获取服务器公网IP
-		resp, err := client.Get("https://icanhazip.com/")
-		if err != nil {
-			log.Printf("获取服务器公网IP失败: %v", err)
-			http.Error(w, "获取服务器公网IP失败", http.StatusInternalServerError)
-			return
-		}
-		defer resp.Body.Close()
+	// 分别通过IPv4和IPv6获取服务器公网IP，没有对应网络的地址族为空
+	var serverIPv4, serverIPv6 string
+	var wg sync.WaitGroup
+	for family, ip := range map[string]*string{FamilyIPv4: &serverIPv4, FamilyIPv6: &serverIPv6} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addr, err := publicIP(r.Context(), family, opts)
+			if err != nil {
+				log.Printf("%v", err)
+				return
+			}
+			*ip = addr
+		}()
+	}
+	wg.Wait()
 
-		// 读取API响应
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("读取API响应失败: %v", err)
+	// 地理位置优先使用IPv4地址查询
+	serverIP := serverIPv4
+	if serverIP == "" {
+		serverIP = serverIPv6
+	}
+	if serverIP == "" {
+		// 如果是本地测试，无法用访问者IP代替服务器公网IP
+		if visitorIP == "::1" || visitorIP == "127.0.0.1" || visitorIP == "localhost" {
 			http.Error(w, "获取服务器公网IP失败", http.StatusInternalServerError)
 			return
 		}
-
-		// 去除换行符
-		serverIP = strings.TrimSpace(string(body))
+		serverIP = visitorIP
 	}
 
 	// 获取服务器IP地理位置信息
 	log.Printf("用于获取地理位置的服务器IP: %s\n", serverIP)
-	geoRespServer, err := http.Get(fmt.Sprintf("http://ip-api.com/json/%s?lang=zh-CN", serverIP))
+	geoRespServer, err := outboundHTTPClient.Get(fmt.Sprintf("http://ip-api.com/json/%s?lang=zh-CN", serverIP))
 	if err != nil {
 		log.Printf("获取服务器IP地理位置信息失败: %v", err)
 		http.Error(w, "获取服务器IP地理位置信息失败", http.StatusInternalServerError)
@@ -359,7 +566,7 @@ func getIPInfoHandler(w http.ResponseWriter, r *http.Request) {
 
 	// 获取访问者IP地理位置信息
 	log.Printf("用于获取地理位置的访问者IP: %s\n", visitorIP)
-	geoRespVisitor, err := http.Get(fmt.Sprintf("http://ip-api.com/json/%s?lang=zh-CN", visitorIP))
+	geoRespVisitor, err := outboundHTTPClient.Get(fmt.Sprintf("http://ip-api.com/json/%s?lang=zh-CN", visitorIP))
 	if err != nil {
 		log.Printf("获取访问者IP地理位置信息失败: %v", err)
 		http.Error(w, "获取访问者IP地理位置信息失败", http.StatusInternalServerError)
@@ -414,8 +621,10 @@ func getIPInfoHandler(w http.ResponseWriter, r *http.Request) {
 
 	// 构造响应数据
 	ipInfo := IPInfo{
-		ServerIP:  serverIPInfo,
-		VisitorIP: visitorIPInfo,
+		ServerIP:   serverIPInfo,
+		ServerIPv4: serverIPv4,
+		ServerIPv6: serverIPv6,
+		VisitorIP:  visitorIPInfo,
 	}
 
 	// 设置响应头